@@ -0,0 +1,190 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+//
+// fake-kubelet test program stands in for kubelet device plugin registration.
+// It accepts device plugin registration, watches plugin device list updates,
+// optionally allocates devices from the plugin (to a fake pod reported through
+// PodResources API), and exits with zero after receiving given number of
+// device list updates.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/intel/fakedev-exporter/version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// podResourcesT reports devices allocated to the fake pod container
+type podResourcesT struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	pod, namespace, container string
+	mutex                     sync.Mutex
+	devices                   []*podresourcesapi.ContainerDevices
+}
+
+var pods podResourcesT
+
+func (p *podResourcesT) List(ctx context.Context, req *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	resp := podresourcesapi.ListPodResourcesResponse{}
+	if len(p.devices) > 0 {
+		resp.PodResources = []*podresourcesapi.PodResources{{
+			Name:      p.pod,
+			Namespace: p.namespace,
+			Containers: []*podresourcesapi.ContainerResources{{
+				Name:    p.container,
+				Devices: p.devices,
+			}},
+		}}
+	}
+	return &resp, nil
+}
+
+// servePodResources() serves PodResources API on given socket
+func servePodResources(socket string) {
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatalf("ERROR: PodResources socket '%s' listening failed: %v", socket, err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, &pods)
+	go server.Serve(l)
+	log.Printf("Serving PodResources for '%s/%s' pod on unix socket '%s'", pods.namespace, pods.pod, socket)
+}
+
+type registrationT struct {
+	pluginapi.UnimplementedRegistrationServer
+	requests chan *pluginapi.RegisterRequest
+}
+
+func (r *registrationT) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	if req.Version != pluginapi.Version {
+		log.Printf("WARN: rejecting '%s' plugin registration with unsupported API version '%s'", req.ResourceName, req.Version)
+		return nil, fmt.Errorf("unsupported device plugin API version '%s'", req.Version)
+	}
+	log.Printf("Device plugin registered for '%s' resource, on '%s' socket", req.ResourceName, req.Endpoint)
+	r.requests <- req
+	return &pluginapi.Empty{}, nil
+}
+
+// serveRegistration() serves kubelet registration API on socket in given
+// directory, and returns channel for the registration requests
+func serveRegistration(dir string) chan *pluginapi.RegisterRequest {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("ERROR: creating device plugin directory '%s' failed: %v", dir, err)
+	}
+	socket := filepath.Join(dir, filepath.Base(pluginapi.KubeletSocket))
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatalf("ERROR: kubelet socket '%s' listening failed: %v", socket, err)
+	}
+	reg := registrationT{requests: make(chan *pluginapi.RegisterRequest, 1)}
+	server := grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(server, &reg)
+	go server.Serve(l)
+	log.Printf("Listening for device plugin registrations on unix socket '%s'", socket)
+	return reg.requests
+}
+
+// allocate() asks plugin to allocate given resource devices for a container,
+// logs the result, and adds them to fake pod resources
+func allocate(client pluginapi.DevicePluginClient, resource string, ids []string) {
+	req := pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: ids}},
+	}
+	resp, err := client.Allocate(context.Background(), &req)
+	if err != nil {
+		log.Fatalf("ERROR: allocating devices %v failed: %v", ids, err)
+	}
+	for _, cresp := range resp.ContainerResponses {
+		log.Printf("Allocated devices %v, env: %v", ids, cresp.Envs)
+		for _, mount := range cresp.Mounts {
+			log.Printf("- mount: %s -> %s", mount.HostPath, mount.ContainerPath)
+		}
+	}
+	pods.mutex.Lock()
+	pods.devices = append(pods.devices, &podresourcesapi.ContainerDevices{ResourceName: resource, DeviceIds: ids})
+	pods.mutex.Unlock()
+}
+
+// watchDevices() connects to registered plugin, and watches its device list
+// until given number of updates has been received.  Given number of healthy
+// devices is allocated after first update
+func watchDevices(dir string, req *pluginapi.RegisterRequest, updates, count int) {
+	socket := filepath.Join(dir, req.Endpoint)
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("ERROR: connecting to device plugin socket '%s' failed: %v", socket, err)
+	}
+	defer conn.Close()
+	client := pluginapi.NewDevicePluginClient(conn)
+	stream, err := client.ListAndWatch(context.Background(), &pluginapi.Empty{})
+	if err != nil {
+		log.Fatalf("ERROR: device plugin ListAndWatch failed: %v", err)
+	}
+	for i := 1; i <= updates; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			log.Fatalf("ERROR: device plugin ListAndWatch receive failed: %v", err)
+		}
+		healthy := make([]string, 0)
+		for _, dev := range resp.Devices {
+			log.Printf("- %s: %s", dev.ID, dev.Health)
+			if dev.Health == pluginapi.Healthy {
+				healthy = append(healthy, dev.ID)
+			}
+		}
+		log.Printf("Update %d/%d: %d/%d '%s' devices healthy", i, updates, len(healthy), len(resp.Devices), req.ResourceName)
+		if i == 1 && count > 0 {
+			if count > len(healthy) {
+				log.Fatalf("ERROR: %d devices requested, but only %d are healthy", count, len(healthy))
+			}
+			allocate(client, req.ResourceName, healthy[:count])
+		}
+	}
+}
+
+func main() {
+	var dir, podSocket string
+	var updates, count int
+	var timeout time.Duration
+	var showVersion bool
+	flag.StringVar(&dir, "dir", "/tmp/fake-kubelet", "Device plugin directory, where kubelet registration socket is created")
+	flag.IntVar(&updates, "updates", 1, "Exit after receiving this many device list updates from the registered plugin")
+	flag.IntVar(&count, "allocate", 0, "How many healthy devices to allocate from the plugin, after first device list update")
+	flag.StringVar(&podSocket, "podresources", "", "If given, PodResources API is served on this unix socket, for the devices allocated to a fake pod")
+	flag.StringVar(&pods.pod, "pod", "fake-pod", "Name of the fake pod to which devices are allocated")
+	flag.StringVar(&pods.namespace, "namespace", "default", "Namespace of the fake pod")
+	flag.StringVar(&pods.container, "container", "fake-container", "Container of the fake pod")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "Exit with error if updates are not received within this time")
+	flag.BoolVar(&showVersion, "version", false, "Show version and build information, and exit")
+	flag.Parse()
+	if showVersion {
+		fmt.Println(version.BuildInfo("fake-kubelet"))
+		os.Exit(0)
+	}
+	time.AfterFunc(timeout, func() {
+		log.Fatalf("ERROR: expected device plugin updates not received within %v", timeout)
+	})
+	requests := serveRegistration(dir)
+	if podSocket != "" {
+		servePodResources(podSocket)
+	}
+	watchDevices(dir, <-requests, updates, count)
+	log.Print("All expected device plugin updates received")
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/intel/fakedev-exporter/wlspec"
+)
+
+// admission limits for (client) WLs, 0 = unlimited (except for backlog)
+var (
+	// how many WL connections can wait for next scrape to read them
+	acceptBacklog uint = wlMaxBatch
+	// how many WLs can use same device at the same time
+	deviceShares uint
+	// how many WLs can be simulated at the same time on the node
+	nodeWorkloads uint
+	// whether WLs exceeding share / node limits are queued instead of rejected
+	queueBusy bool
+	// how many WLs can be queued
+	queueSize uint
+)
+
+// queuedWorkloadT is a (client) WL waiting to be admitted
+type queuedWorkloadT struct {
+	info   *wlspec.SpecT
+	client *clientT
+	since  time.Time
+	reason string // why WL is still waiting
+}
+
+// WLs waiting for admission, in queuing order
+var queued []queuedWorkloadT
+
+// isQueueable() returns whether WL rejected for given reason could be
+// admitted later, when other WLs end
+func isQueueable(reason string) bool {
+	return reason == rejectBusy || reason == rejectNodeLimit
+}
+
+// clientWorkloads() returns number of currently simulated (client) WLs
+func clientWorkloads() int {
+	count := 0
+	for _, wl := range workload {
+		if wl.client != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// deviceUsers() returns number of (client) WLs using each device.
+// Base loads do not count, as they are just background load
+func deviceUsers() map[int]int {
+	users := make(map[int]int)
+	for _, wl := range workload {
+		if wl.client == nil {
+			continue // base load
+		}
+		for dev := range wl.devmap {
+			users[dev]++
+		}
+	}
+	return users
+}
+
+// isFree() returns whether device with given number of (client) WL users
+// can be allocated to another WL. Without share limit, only unused devices
+// are free
+func isFree(users int) bool {
+	if deviceShares == 0 {
+		return users == 0
+	}
+	return users < int(deviceShares)
+}
+
+// busyDevices() logs and returns number of given devices which have no free
+// shares, when device shares are limited. Those would be double-allocations
+// with a real device plugin
+func busyDevices(name string, devmap map[int]bool) int {
+	if deviceShares == 0 {
+		return 0
+	}
+	users := deviceUsers()
+	busy := 0
+	for dev := range devmap {
+		if isFree(users[dev]) {
+			continue
+		}
+		owners := make([]string, 0, users[dev])
+		for _, wl := range workload {
+			if wl.client != nil && wl.devmap[dev] {
+				owners = append(owners, wl.name)
+			}
+		}
+		log.Printf("WARN, WL '%s' device %d ('%s') already allocated to %d/%d WL(s): %v",
+			name, dev, devinfo.deviceLabels[dev]["file"], users[dev], deviceShares, owners)
+		busy++
+	}
+	return busy
+}
+
+// admit() checks whether (client) WL with given name can be simulated on
+// given devices, within the node and device share limits.  Returns
+// rejection reason if not
+func admit(name string, devmap map[int]bool) string {
+	if nodeWorkloads > 0 && clientWorkloads() >= int(nodeWorkloads) {
+		log.Printf("WARN, node WL limit (%d) reached, WL '%s' not admitted", nodeWorkloads, name)
+		return rejectNodeLimit
+	}
+	if busyDevices(name, devmap) > 0 {
+		return rejectBusy
+	}
+	return ""
+}
+
+// rejectWorkload() tells given client WL to exit with an error,
+// for given rejection reason, and counts that
+func rejectWorkload(client *clientT, reason string) {
+	stats.rejected[reason]++
+	client.reply(wlspec.ErrorReply(reason), dequeueRejected)
+}
+
+// queueWorkload() queues given WL rejected for given reason, if that
+// reason is queueable, or rejects it if queue is full.  Returns false
+// if caller needs to reject the WL instead
+func queueWorkload(info *wlspec.SpecT, client *clientT, reason string) bool {
+	if !queueBusy || !isQueueable(reason) {
+		return false
+	}
+	if queueSize > 0 && len(queued) >= int(queueSize) {
+		log.Printf("WARN, WL queue full (%d), rejecting WL '%s'", queueSize, info.Name)
+		rejectWorkload(client, rejectQueueFull)
+		return true
+	}
+	log.Printf("Queuing WL '%s' (%s) until it can be admitted", info.Name, reason)
+	queued = append(queued, queuedWorkloadT{info, client, time.Now(), reason})
+	stats.queued++
+	return true
+}
+
+// startQueued() starts queued WLs which can now be admitted, in their
+// queuing order, and drops cancelled and disconnected ones from the queue
+func startQueued() {
+	waiting := make([]queuedWorkloadT, 0, len(queued))
+	for _, wl := range queued {
+		name := fmt.Sprintf("Queued WL '%s'", wl.info.Name)
+		if reason := wl.client.ended(); reason != "" {
+			stats.dequeued[reason]++
+			continue
+		}
+		reason := startWorkload(wl.info, nil, wl.client)
+		switch {
+		case reason == "":
+			log.Printf("%s started after %v in queue", name, time.Since(wl.since))
+			stats.dequeued[dequeueStarted]++
+		case isQueueable(reason):
+			wl.reason = reason
+			waiting = append(waiting, wl)
+		default:
+			stats.dequeued[dequeueRejected]++
+			rejectWorkload(wl.client, reason)
+		}
+	}
+	queued = waiting
+}
+
+// queueDepth() returns number of queued WLs per reason for waiting
+func queueDepth() map[string]uint64 {
+	depth := map[string]uint64{rejectBusy: 0, rejectNodeLimit: 0}
+	for _, wl := range queued {
+		depth[wl.reason]++
+	}
+	return depth
+}
+
+// oldestQueued() returns how long the oldest queued WL has waited, in seconds
+func oldestQueued() float64 {
+	if len(queued) == 0 {
+		return 0
+	}
+	return time.Since(queued[0].since).Seconds()
+}
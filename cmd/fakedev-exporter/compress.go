@@ -0,0 +1,108 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoderT is compressing writer, which can be reused for another output
+type encoderT interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// encoders for supported content encodings, in order of preference.  Pools
+// avoid (relatively expensive) encoder setup on each scrape
+var encoders = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"zstd", &sync.Pool{New: func() any {
+		// response is compressed at once, extra go routines would not help
+		w, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			log.Printf("WARN: zstd encoder creation failed: %v", err)
+			return nil
+		}
+		return w
+	}}},
+	{"gzip", &sync.Pool{New: func() any { return gzip.NewWriter(nil) }}},
+}
+
+// acceptedEncodings() returns content encodings accepted by the client,
+// according to given Accept-Encoding header value.  Ones with zero
+// quality value are ignored
+func acceptedEncodings(header string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value <= 0 {
+				continue
+			}
+		}
+		accepted[name] = true
+	}
+	return accepted
+}
+
+// compress() compresses given data with preferred encoding accepted by client,
+// and returns encoding name with compressed data.  If client does not accept
+// any supported encoding, or compression fails, empty name and original data
+// are returned
+func compress(header string, data []byte) (string, []byte) {
+	accepted := acceptedEncodings(header)
+	for _, enc := range encoders {
+		if !accepted[enc.name] && !accepted["*"] {
+			continue
+		}
+		w, ok := enc.pool.Get().(encoderT)
+		if !ok {
+			return "", data
+		}
+		var buf bytes.Buffer
+		w.Reset(&buf)
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			// encoder state is unknown, so it's not reused
+			log.Printf("WARN: %s compression failed: %v", enc.name, err)
+			return "", data
+		}
+		enc.pool.Put(w)
+		return enc.name, buf.Bytes()
+	}
+	return "", data
+}
+
+// writeResponse() writes given metrics data to response, compressed
+// if client accepts that, with headers matching the content
+func writeResponse(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Add("Vary", "Accept-Encoding")
+	encoding, data := compress(r.Header.Get("Accept-Encoding"), data)
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("WARN: metrics response write failed: %v", err)
+	}
+}
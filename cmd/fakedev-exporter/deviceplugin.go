@@ -0,0 +1,192 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	pluginSocket = project + ".sock"
+	pluginEnv    = "FAKEDEV_DEVICES" // allocated device IDs, for WL -device-env option
+	pluginCheck  = 5 * time.Second   // plugin socket check + registration retry interval
+)
+
+// device plugin options
+var (
+	// extended resource name, device plugin is disabled if empty
+	pluginResource string
+	// kubelet device plugin directory, with kubelet registration socket
+	pluginDir string
+	// host directory for fake device files, and their path in containers
+	pluginDevDir  string
+	pluginDevPath string
+)
+
+// devicePluginT implements kubelet device plugin API for simulated devices,
+// which device IDs are their file names
+type devicePluginT struct {
+	pluginapi.UnimplementedDevicePluginServer
+}
+
+// pluginDevices() returns simulated devices with their health, in device
+// index order.  Needs to be called with simulation mutex held
+func pluginDevices() []*pluginapi.Device {
+	devices := make([]*pluginapi.Device, 0, len(devinfo.deviceLabels))
+	for dev, labels := range devinfo.deviceLabels {
+		health := pluginapi.Healthy
+		if faulted[dev] {
+			health = pluginapi.Unhealthy
+		}
+		devices = append(devices, &pluginapi.Device{ID: labels["file"], Health: health})
+	}
+	return devices
+}
+
+func (p *devicePluginT) GetDevicePluginOptions(ctx context.Context, e *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	return &pluginapi.DevicePluginOptions{}, nil
+}
+
+// ListAndWatch sends device list to kubelet, and again whenever device health changes
+func (p *devicePluginT) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	for {
+		mutex.Lock()
+		devices := pluginDevices()
+		changed := healthChange
+		mutex.Unlock()
+		log.Printf("Device plugin sending %d device(s) to kubelet", len(devices))
+		if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+			log.Printf("WARN, device plugin ListAndWatch send failed: %v", err)
+			return err
+		}
+		select {
+		case <-changed:
+		case <-s.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Allocate provides container(s) with env variable listing their device IDs,
+// and mounts for their fake device files
+func (p *devicePluginT) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	resp := pluginapi.AllocateResponse{}
+	for _, creq := range req.ContainerRequests {
+		cresp := pluginapi.ContainerAllocateResponse{
+			Envs: map[string]string{pluginEnv: strings.Join(creq.DevicesIDs, ",")},
+		}
+		for _, id := range creq.DevicesIDs {
+			if _, exists := devinfo.devicemap[id]; !exists {
+				log.Printf("WARN, device plugin asked to allocate unknown device '%s'", id)
+				return nil, fmt.Errorf("unknown device '%s'", id)
+			}
+			cresp.Mounts = append(cresp.Mounts, &pluginapi.Mount{
+				ContainerPath: filepath.Join(pluginDevPath, id),
+				HostPath:      filepath.Join(pluginDevDir, id),
+			})
+		}
+		log.Printf("Device plugin allocated devices: %v", creq.DevicesIDs)
+		resp.ContainerResponses = append(resp.ContainerResponses, &cresp)
+	}
+	return &resp, nil
+}
+
+// createDeviceFiles() creates (empty) fake device files for the simulated
+// devices to host directory, for device plugin to mount into containers.
+// Modes are set explicitly, as exporter umask would restrict them
+func createDeviceFiles() {
+	if err := os.MkdirAll(pluginDevDir, 0755); err != nil {
+		log.Fatalf("Creating fake device file directory '%s' failed: %v", pluginDevDir, err)
+	}
+	if err := os.Chmod(pluginDevDir, 0755); err != nil {
+		log.Fatalf("Setting fake device file directory '%s' mode failed: %v", pluginDevDir, err)
+	}
+	for name := range devinfo.devicemap {
+		if strings.Contains(name, "/") {
+			log.Fatalf("Device file name '%s' can not be used as device plugin device ID", name)
+		}
+		path := filepath.Join(pluginDevDir, name)
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			log.Fatalf("Creating fake device file '%s' failed: %v", path, err)
+		}
+		// containers using the device may run as any user
+		if err := os.Chmod(path, 0666); err != nil {
+			log.Fatalf("Setting fake device file '%s' mode failed: %v", path, err)
+		}
+	}
+}
+
+// servePlugin() starts serving device plugin API on given unix socket.
+// Returns the server, or nil on failure
+func servePlugin(socket string) *grpc.Server {
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Printf("WARN, device plugin socket '%s' listening failed: %v", socket, err)
+		return nil
+	}
+	server := grpc.NewServer()
+	pluginapi.RegisterDevicePluginServer(server, &devicePluginT{})
+	go server.Serve(l)
+	log.Printf("Device plugin listening on unix socket '%s'", socket)
+	return server
+}
+
+// registerPlugin() registers device plugin for the resource to kubelet
+func registerPlugin() error {
+	kubelet := filepath.Join(pluginDir, filepath.Base(pluginapi.KubeletSocket))
+	conn, err := grpc.Dial("unix://"+kubelet, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), pluginCheck)
+	defer cancel()
+	_, err = pluginapi.NewRegistrationClient(conn).Register(ctx, &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     pluginSocket,
+		ResourceName: pluginResource,
+		Options:      &pluginapi.DevicePluginOptions{},
+	})
+	return err
+}
+
+// runDevicePlugin() serves device plugin API for the simulated devices, and
+// registers it to kubelet.  When kubelet (on restart) removes plugin socket,
+// plugin is re-started and re-registered.  Does not return
+func runDevicePlugin() {
+	createDeviceFiles()
+	socket := filepath.Join(pluginDir, pluginSocket)
+	for {
+		server := servePlugin(socket)
+		if server == nil {
+			time.Sleep(pluginCheck)
+			continue
+		}
+		if err := registerPlugin(); err != nil {
+			log.Printf("WARN, device plugin '%s' registration to kubelet failed: %v", pluginResource, err)
+			time.Sleep(pluginCheck)
+		} else {
+			log.Printf("Device plugin registered to kubelet for '%s' resource", pluginResource)
+			for {
+				time.Sleep(pluginCheck)
+				if _, err := os.Stat(socket); err != nil {
+					log.Printf("Device plugin socket '%s' removed, re-registering", socket)
+					break
+				}
+			}
+		}
+		server.Stop()
+	}
+}
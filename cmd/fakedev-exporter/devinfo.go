@@ -3,10 +3,11 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha1"
+	"fmt"
 	"log"
-	"os"
 	"sort"
+	"strings"
 )
 
 // limitT state min and max values for given metr, which could act also
@@ -24,182 +25,245 @@ type devtypeT struct {
 }
 
 type devlistT struct {
-	// per-device labels
+	// per-device labels, when generator is used, these override
+	// (same index) generated device labels
 	DeviceLabels []map[string]string
+	// optional generator for any number of device instances
+	Generator *generatorT
 }
 
-type labelPairT struct {
-	name, value string
+// generatorT specifies how per-device labels are generated for devices
+type generatorT struct {
+	// label name -> value template, where "{N}" is replaced with device index
+	Labels map[string]string
+	// PCI address ("addr" label) for first device, incremented for rest
+	Addr string
+	// PCI device numbers per bus before going to next one (default 32)
+	DevicesPerBus uint
+	// how much bus number is incremented when bus is full (default 1)
+	BusStep uint
+}
+
+// pciAddrT is PCI address in domain:bus:device.function format
+type pciAddrT struct {
+	domain, bus, device, function uint
+}
+
+// parsePCIAddr returns given PCI address string parsed, or error
+func parsePCIAddr(addr string) (pciAddrT, error) {
+	var a pciAddrT
+	n, err := fmt.Sscanf(addr, "%x:%x:%x.%x", &a.domain, &a.bus, &a.device, &a.function)
+	if err != nil || n != 4 || a.bus > 0xff || a.device > 0x1f || a.function > 7 {
+		return a, fmt.Errorf("invalid PCI address '%s' (not in DDDD:BB:DD.F format)", addr)
+	}
+	return a, nil
+}
+
+// generateLabels returns labels for given device index, and PCI address for
+// given device instance number (same as index unless there are several device
+// groups), or error if generated PCI address would overflow domain numbers.
+// When bus numbers run out, addresses continue from next PCI domain
+// (with the same starting bus number)
+func (g *generatorT) generateLabels(dev, instance int) (map[string]string, error) {
+	labels := make(map[string]string, len(g.Labels)+1)
+	for label, value := range g.Labels {
+		labels[label] = strings.ReplaceAll(value, "{N}", fmt.Sprint(dev))
+	}
+	if g.Addr == "" {
+		return labels, nil
+	}
+	addr, err := parsePCIAddr(g.Addr)
+	if err != nil {
+		return nil, err
+	}
+	perBus, busStep := g.DevicesPerBus, g.BusStep
+	if perBus == 0 || perBus > 32 {
+		perBus = 32
+	}
+	if busStep == 0 {
+		busStep = 1
+	}
+	slot := addr.device + uint(instance)
+	bus := slot / perBus
+	buses := (0xff-addr.bus)/busStep + 1 // per domain
+	addr.domain += bus / buses
+	addr.bus += (bus % buses) * busStep
+	addr.device = slot % perBus
+	if addr.domain > 0xffff {
+		return nil, fmt.Errorf("device[%d] PCI domain number overflow (0x%x)", dev, addr.domain)
+	}
+	labels["addr"] = fmt.Sprintf("%04x:%02x:%02x.%x", addr.domain, addr.bus, addr.device, addr.function)
+	return labels, nil
 }
 
 // devinfoT stores both common and per-device information on device labels,
-// what are their metric limits, metric specific labels and which of those
-// should be exported.  Latter two are filled based on identity info
+// and what are their metric limits.  Identity specific output information
+// is in outputT
 type devinfoT struct {
-	// per-device labels (len=device count)
-	deviceLabels [][]labelPairT
-	// per-metric limits
+	// per-device labels, including device type ones (len=device count)
+	deviceLabels []map[string]string
+	// per-device metric limits (len=device count)
+	deviceLimits []map[string]limitT
+	// limits for all metrics, from first device type having given metric
 	metricLimits map[string]limitT
 
 	// per-device file name -> array index mapping
 	devicemap map[string]int
-	// per-metric labels (if any)
-	metricLabels map[string][]labelPairT
-	// list of metrics to output
-	output []string
+	// device labels generated by exporter (unless given in devlist)
+	generated map[string]bool
 }
 
-// identityT maps devinfo metric and label names to exporter ones.
-// If name is missing, it's not output. If value is "", name is not changed.
-// NOTE: member names need to be capitalized for JSON marshaling to use them.
-type identityT struct {
-	DeviceLabelMap map[string]string
-	MetricMap      map[string]string
-	MetricLabels   map[string]map[string]string
+// names for the generated device labels
+const (
+	labelIndex = "index"
+	labelUUID  = "uuid"
+)
+
+// deviceUUID returns (RFC 4122 version 5 style) UUID derived from given
+// device labels, so that it stays same as long as the labels do
+func deviceUUID(labels map[string]string) string {
+	h := sha1.New()
+	for _, label := range sortedLabels(labels) {
+		fmt.Fprintf(h, "%s=%s\n", label.name, label.value)
+	}
+	sum := h.Sum(nil)
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
 }
 
-// mapLabels removes labels from mapping which do not exist in exporter identity,
-// and maps rest to identity label names. Returns the (label,value) slice as result,
-// and list of labels missing a mapping
-func mapLabels(labels map[string]string, identity identityT) ([]labelPairT, []string) {
-	missing := make([]string, 0)
-	result := make([]labelPairT, 0)
-	for label, value := range labels {
-		name, exists := identity.DeviceLabelMap[label]
-		if exists {
-			// log.Printf("device label mapping: '%s' -> '%s' = '%s'", label, name, value)
-			result = append(result, labelPairT{name, value})
-		} else {
-			// log.Printf("missing mapping for device label '%s'", label)
-			missing = append(missing, label)
+// check adds problems for invalid generator values in given file
+func (g *generatorT) check(file string, p *problemsT) {
+	if g.Addr != "" {
+		if _, err := parsePCIAddr(g.Addr); err != nil {
+			p.errorf(file, "Generator.Addr", "%v", err)
 		}
 	}
-	return result, missing
+	if g.DevicesPerBus > 32 {
+		p.errorf(file, "Generator.DevicesPerBus", "%d is more than PCI bus can have (32)", g.DevicesPerBus)
+	}
+	if len(g.Labels) == 0 && g.Addr == "" {
+		p.warnf(file, "Generator", "neither Labels nor Addr to generate")
+	}
 }
 
-// sortLabelList sorts given references label list and return its reference
-func sortLabelList(labels []labelPairT) []labelPairT {
-	sort.SliceStable(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
-	return labels
+// checkLimits adds problems for invalid metric limits in given file
+func checkLimits(file string, limits map[string]limitT, p *problemsT) {
+	if len(limits) == 0 {
+		p.warnf(file, "MetricLimits", "no metrics specified")
+	}
+	for _, metric := range sortedKeys(limits) {
+		if limit := limits[metric]; limit.Min > limit.Max {
+			p.errorf(file, "MetricLimits."+metric, "Min (%g) > Max (%g)", limit.Min, limit.Max)
+		}
+	}
 }
 
 // getDevinfo is called at startup to load device information from specified
-// JSON config files.  devcount specifies how many devices (with per-instance labels
-// from devlist) are to be created.  Device label and limit names are mapped based on
-// loaded exporter identity. Labels are also filtered by identity at startup, but
-// metrics only on output.  Latter is to make sure that metric derivation works correctly.
-func getDevinfo(devcount int, typefile, listfile, idfile string) devinfoT {
+// JSON config files.  devcount specifies how many devices (with per-instance
+// labels from devlist, or its generator) are to be created.  Config issues are
+// added to given problems, and if they prevent creating devices, returned info
+// has no device labels.  Device labels and metrics are mapped to output names
+// per exporter identity, see getOutput().
+func getDevinfo(devcount int, typefile, listfile string, p *problemsT) devinfoT {
 	var (
-		identity  identityT
-		devtype   devtypeT
-		devlist   devlistT
-		devlabels []labelPairT
-		info      devinfoT
-		text      []byte
-		err       error
+		devtype devtypeT
+		devlist devlistT
+		info    devinfoT
 	)
-	if text, err = os.ReadFile(idfile); err != nil {
-		log.Fatalf("Unable to read exporter identity JSON file '%s': %v", idfile, err)
+	typeOK := readJSON(typefile, &devtype, p)
+	if typeOK {
+		log.Printf("devtype: %+v\n", devtype)
+		checkLimits(typefile, devtype.MetricLimits, p)
 	}
-	log.Printf("identity: %s\n", string(text))
-	if err = json.Unmarshal(text, &identity); err != nil {
-		log.Fatalf("Unmarshaling failed for identity JSON file '%s': %v", idfile, err)
+	if !readJSON(listfile, &devlist, p) || !typeOK {
+		return info
 	}
-
-	if text, err = os.ReadFile(typefile); err != nil {
-		log.Fatalf("Unable to read device type JSON file '%s': %v", typefile, err)
-	}
-	log.Printf("devtype: %s\n", string(text))
-	if err = json.Unmarshal(text, &devtype); err != nil {
-		log.Fatalf("Unmarshaling failed for device type JSON file '%s': %v", typefile, err)
-	}
-	var missing []string
-	devlabels, missing = mapLabels(devtype.DeviceLabels, identity)
-	if len(missing) > 0 {
-		log.Printf("WARN: no identity mapping for device type labels: %v", missing)
+	if !info.addDevices(devtype, devlist, devcount, listfile, p) {
+		info.deviceLabels, info.deviceLimits = nil, nil
 	}
+	return info
+}
 
-	if text, err = os.ReadFile(listfile); err != nil {
-		log.Fatalf("Unable to read device list JSON file '%s': %v", listfile, err)
+// addDevices adds devcount devices of given type to device info, with
+// per-instance labels from given devlist (file).  Device index and UUID labels
+// are generated for devices, unless devlist already provides them.  Returns
+// false if there were (devlist) errors
+func (info *devinfoT) addDevices(devtype devtypeT, devlist devlistT, devcount int, listfile string, p *problemsT) bool {
+	errors := p.errorCount()
+	if devlist.Generator != nil {
+		devlist.Generator.check(listfile, p)
+	} else if len(devlist.DeviceLabels) < devcount {
+		p.errorf(listfile, "DeviceLabels", "fewer devices than requested (%d < %d)",
+			len(devlist.DeviceLabels), devcount)
 	}
-	if err = json.Unmarshal(text, &devlist); err != nil {
-		log.Fatalf("Unmarshaling failed for device list JSON file '%s': %v", listfile, err)
+	if p.errorCount() > errors {
+		return false
 	}
-	if len(devlist.DeviceLabels) < devcount {
-		log.Fatalf("Device list contains fewer devices than requested (%d < %d): %s",
-			len(devlist.DeviceLabels), devcount, listfile)
+	if info.devicemap == nil {
+		info.devicemap = make(map[string]int, devcount)
+		info.generated = map[string]bool{labelIndex: true, labelUUID: true}
+		info.metricLimits = make(map[string]limitT, len(devtype.MetricLimits))
 	}
-	var (
-		name   string
-		exists bool
-	)
-	info.deviceLabels = make([][]labelPairT, devcount)
-	info.devicemap = make(map[string]int, devcount)
-	for dev := 0; dev < devcount; dev++ {
-		if _, exists := devlist.DeviceLabels[dev]["file"]; !exists {
-			log.Fatalf("devlist[%d] missing 'file' label (used for matching WL device file names)", dev)
+	first := len(info.deviceLabels)
+	for i := 0; i < devcount; i++ {
+		dev := first + i
+		// combine type labels with generated and per-device labels
+		labels := make(map[string]string)
+		for label, value := range devtype.DeviceLabels {
+			labels[label] = value
 		}
-		info.devicemap[devlist.DeviceLabels[dev]["file"]] = dev
-
-		// map per-device labels + add (already mapped) type labels
-		labels, missing := mapLabels(devlist.DeviceLabels[dev], identity)
-		if len(missing) > 0 {
-			log.Printf("WARN: no identity mapping for devlist[%d] labels: %v", dev, missing)
-		}
-		for _, label := range devlabels {
-			labels = append(labels, label)
-		}
-		// warn of missing labels before assignment
-		for label, value := range identity.DeviceLabelMap {
-			if _, exists := devlist.DeviceLabels[dev][value]; exists {
-				continue
+		if devlist.Generator != nil {
+			generated, err := devlist.Generator.generateLabels(dev, i)
+			if err != nil {
+				p.errorf(listfile, "Generator", "%v", err)
+				return false
 			}
-			if _, exists := devtype.DeviceLabels[value]; exists {
-				continue
+			for label, value := range generated {
+				labels[label] = value
 			}
-			log.Printf("WARN: device[%d] label missing for identity mapping: '%s'", dev, label)
 		}
-		info.deviceLabels[dev] = sortLabelList(labels)
-	}
-	// complain about missing metrics
-	for metric := range identity.MetricMap {
-		if _, exists := devtype.MetricLimits[metric]; !exists {
-			log.Printf("WARN: no device type metric/limit for identity mapping: '%s'", metric)
+		if i < len(devlist.DeviceLabels) {
+			for label, value := range devlist.DeviceLabels[i] {
+				labels[label] = value
+			}
 		}
-	}
-	// map (matching) device metric limit names to output names
-	info.metricLimits = make(map[string]limitT)
-	for metric, limit := range devtype.MetricLimits {
-		if name, exists = identity.MetricMap[metric]; !exists {
-			log.Printf("WARN: no identity mapping for device metric/limit: '%s'", metric)
-			continue
+		path := fmt.Sprintf("DeviceLabels[%d]", i)
+		if file, exists := labels["file"]; !exists {
+			p.errorf(listfile, path, "missing 'file' label (used for matching WL device file names)")
+		} else if prev, exists := info.devicemap[file]; exists {
+			p.errorf(listfile, path, "'file' label '%s' duplicates device[%d] one", file, prev)
+		} else {
+			info.devicemap[file] = dev
 		}
-		info.metricLimits[name] = limit
-		log.Printf("metric/limit name identity mapping: '%s' -> '%s'", metric, name)
-	}
-	// map metric info labels
-	info.metricLabels = make(map[string][]labelPairT, len(identity.MetricLabels))
-	for metric, labels := range identity.MetricLabels {
-		name, exists := identity.MetricMap[metric]
-		if !exists {
-			log.Fatalf("identity MetricMap[%s] missing for MetricLabels", metric)
+		if _, exists := labels[labelUUID]; !exists {
+			labels[labelUUID] = deviceUUID(labels)
 		}
-		i := 0
-		ll := make([]labelPairT, len(labels))
-		for label, value := range labels {
-			ll[i] = labelPairT{label, value}
-			i++
+		if _, exists := labels[labelIndex]; !exists {
+			labels[labelIndex] = fmt.Sprint(dev)
 		}
-		info.metricLabels[name] = sortLabelList(ll)
+		info.deviceLabels = append(info.deviceLabels, labels)
+		info.deviceLimits = append(info.deviceLimits, devtype.MetricLimits)
 	}
-	// which device metrics to output
-	i := 0
-	out := make([]string, len(identity.MetricMap))
-	for _, name := range identity.MetricMap {
-		out[i] = name
-		i++
+	for metric, limit := range devtype.MetricLimits {
+		if _, exists := info.metricLimits[metric]; !exists {
+			info.metricLimits[metric] = limit
+		}
 	}
-	sort.Strings(out)
-	info.output = out
-	return info
+	return p.errorCount() == errors
+}
+
+// sortedLabels returns given device labels as list sorted by label name
+func sortedLabels(labels map[string]string) []labelPairT {
+	list := make([]labelPairT, 0, len(labels))
+	for label, value := range labels {
+		list = append(list, labelPairT{label, value})
+	}
+	return sortLabelList(list)
+}
+
+// sortLabelList sorts given references label list and return its reference
+func sortLabelList(labels []labelPairT) []labelPairT {
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
 }
@@ -0,0 +1,69 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var (
+	// URL path for device fault injection, on default address
+	faultPath string
+	// faulted devices, accessed with simulation mutex held
+	faulted = make(map[int]bool)
+	// closed and replaced when device health changes
+	healthChange = make(chan struct{})
+)
+
+// setFault() sets or clears fault for given device, and notifies
+// health watchers if that changed its health.  Needs to be called
+// with simulation mutex held
+func setFault(dev int, fault bool) {
+	if faulted[dev] == fault {
+		return
+	}
+	if fault {
+		faulted[dev] = true
+	} else {
+		delete(faulted, dev)
+	}
+	log.Printf("Device-%d ('%s') fault: %v", dev, devinfo.deviceLabels[dev]["file"], fault)
+	close(healthChange)
+	healthChange = make(chan struct{})
+}
+
+// faultHandler() returns HTTP handler for listing (GET) faulted devices,
+// and for setting (PUT) or clearing (DELETE) fault for a device, given
+// with its file name in "device" query parameter
+func faultHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodDelete:
+			name := r.URL.Query().Get("device")
+			dev, exists := devinfo.devicemap[name]
+			if !exists {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "unknown device '%s'\n", name)
+				return
+			}
+			setFault(dev, r.Method == http.MethodPut)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for dev := range devinfo.deviceLabels {
+			if faulted[dev] {
+				fmt.Fprintln(w, devinfo.deviceLabels[dev]["file"])
+			}
+		}
+	}
+}
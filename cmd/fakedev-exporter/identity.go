@@ -0,0 +1,422 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/intel/fakedev-exporter/version"
+)
+
+// default separator between output labels
+const defaultLabelSeparator = ", "
+
+type labelPairT struct {
+	name, value string
+}
+
+// outputT stores exporter identity specific information on where and how
+// device metrics are output: mapped device and metric specific labels, and
+// which metrics should be exported.  These are filled based on identity info
+type outputT struct {
+	// identity file name
+	name string
+	// endpoint from which metrics are served
+	address, path string
+
+	// per-device mapped labels (len=device count)
+	deviceLabels [][]labelPairT
+	// per-metric labels (if any)
+	metricLabels map[string][]labelPairT
+	// per-metric device labels to output, all if metric is missing
+	metricDeviceLabels map[string]map[string]bool
+	// per-metric output value conversions (if any)
+	metricConversion map[string]conversionT
+	// pod attribute labels for devices allocated to pods (if any)
+	podLabels []podLabelT
+	// whether to output sample timestamps
+	timestamps bool
+	// separator between text format labels
+	labelSeparator string
+	// comment line at start of text format output, empty for none
+	header string
+	// output metric name -> device metric name
+	metrics map[string]string
+	// list of metrics to output
+	output []string
+}
+
+// podLabelT is output label name for a pod attribute
+type podLabelT struct {
+	attr, name string
+}
+
+// conversionT specifies metric output value conversion: value * Scale + Offset,
+// rounded to integer if Round is set.  Zero Scale is treated as 1, i.e. no scaling
+type conversionT struct {
+	Scale  float64
+	Offset float64
+	Round  bool
+}
+
+// identityT maps devinfo metric and label names to exporter ones.
+// If name is missing, it's not output. If value is "", name is not changed.
+// Rest of the members are for emulating specific exporter output quirks:
+// per-metric output value conversion (e.g. MHz -> Hz), per-metric list of
+// device labels to output, prefixes for device label values (e.g. "GPU-"
+// for UUIDs), whether samples have explicit timestamps, labels for pods
+// owning the devices, text format label separator (default ", "), and
+// text format header comment (nil for default one, "" for none).
+// NOTE: member names need to be capitalized for JSON marshaling to use them.
+type identityT struct {
+	DeviceLabelMap     map[string]string
+	MetricMap          map[string]string
+	MetricLabels       map[string]map[string]string
+	MetricConversion   map[string]conversionT
+	MetricDeviceLabels map[string][]string
+	DeviceLabelPrefix  map[string]string
+	Timestamps         bool
+	PodLabels          map[string]string
+	LabelSeparator     string
+	Header             *string
+}
+
+var (
+	// valid Prometheus metric and label names
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// checkLabelName returns error if given label name is not valid for Prometheus
+func checkLabelName(name string) error {
+	if !labelNameRE.MatchString(name) {
+		return fmt.Errorf("invalid label name '%s'", name)
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("label name '%s' uses reserved '__' prefix", name)
+	}
+	return nil
+}
+
+// checkIdentity sets unchanged ("") identity names to original names, and
+// adds problems for metric or label names not valid for Prometheus, for
+// duplicate output names, and for identity members referring to missing mappings
+func checkIdentity(file string, identity *identityT, p *problemsT) {
+	// output label name -> identity member mapping to it
+	outLabels := make(map[string]string)
+	for _, label := range sortedKeys(identity.DeviceLabelMap) {
+		name := identity.DeviceLabelMap[label]
+		if name == "" {
+			name = label
+			identity.DeviceLabelMap[label] = name
+		}
+		path := "DeviceLabelMap." + label
+		if err := checkLabelName(name); err != nil {
+			p.errorf(file, path, "%v", err)
+		}
+		if prev, exists := outLabels[name]; exists {
+			p.errorf(file, path, "label '%s' duplicates %s one", name, prev)
+		}
+		outLabels[name] = path
+	}
+	outMetrics := make(map[string]string)
+	for _, metric := range sortedKeys(identity.MetricMap) {
+		name := identity.MetricMap[metric]
+		if name == "" {
+			name = metric
+			identity.MetricMap[metric] = name
+		}
+		path := "MetricMap." + metric
+		if !metricNameRE.MatchString(name) {
+			p.errorf(file, path, "invalid metric name '%s'", name)
+		}
+		if prev, exists := outMetrics[name]; exists {
+			p.errorf(file, path, "metric '%s' duplicates %s one", name, prev)
+		}
+		outMetrics[name] = path
+	}
+	for label := range identity.DeviceLabelPrefix {
+		if _, exists := identity.DeviceLabelMap[label]; !exists {
+			p.errorf(file, "DeviceLabelPrefix."+label, "no DeviceLabelMap entry for it")
+		}
+	}
+	for metric, labels := range identity.MetricLabels {
+		if _, exists := identity.MetricMap[metric]; !exists {
+			p.errorf(file, "MetricLabels."+metric, "no MetricMap entry for it")
+		}
+		for label := range labels {
+			path := "MetricLabels." + metric + "." + label
+			if err := checkLabelName(label); err != nil {
+				p.errorf(file, path, "%v", err)
+			}
+			for _, name := range identity.DeviceLabelMap {
+				if name == label {
+					p.errorf(file, path, "label '%s' duplicates device label", label)
+				}
+			}
+		}
+	}
+	for metric := range identity.MetricConversion {
+		if _, exists := identity.MetricMap[metric]; !exists {
+			p.errorf(file, "MetricConversion."+metric, "no MetricMap entry for it")
+		}
+	}
+	for _, attr := range sortedKeys(identity.PodLabels) {
+		name := identity.PodLabels[attr]
+		switch attr {
+		case podAttrPod, podAttrNamespace, podAttrContainer:
+		default:
+			p.errorf(file, "PodLabels."+attr, "unknown pod attribute, not one of: %s, %s, %s",
+				podAttrPod, podAttrNamespace, podAttrContainer)
+			continue
+		}
+		if name == "" {
+			name = attr
+			identity.PodLabels[attr] = name
+		}
+		path := "PodLabels." + attr
+		if err := checkLabelName(name); err != nil {
+			p.errorf(file, path, "%v", err)
+		}
+		if prev, exists := outLabels[name]; exists {
+			p.errorf(file, path, "label '%s' duplicates %s one", name, prev)
+		}
+		outLabels[name] = path
+		for _, metric := range sortedKeys(identity.MetricLabels) {
+			if _, exists := identity.MetricLabels[metric][name]; exists {
+				p.errorf(file, path, "label '%s' duplicates MetricLabels.%s one", name, metric)
+			}
+		}
+	}
+	// text format allows only whitespace around label separator comma
+	if sep := identity.LabelSeparator; sep != "" && strings.Trim(sep, " \t") != "," {
+		p.errorf(file, "LabelSeparator", "'%s' is not comma with optional spaces", sep)
+	}
+	if header := identity.Header; header != nil && *header != "" &&
+		(!strings.HasPrefix(*header, "#") || strings.Contains(*header, "\n")) {
+		p.errorf(file, "Header", "'%s' is not a single comment line", *header)
+	}
+	for metric, labels := range identity.MetricDeviceLabels {
+		if _, exists := identity.MetricMap[metric]; !exists {
+			p.errorf(file, "MetricDeviceLabels."+metric, "no MetricMap entry for it")
+		}
+		for i, label := range labels {
+			if _, exists := identity.DeviceLabelMap[label]; !exists {
+				p.errorf(file, fmt.Sprintf("MetricDeviceLabels.%s[%d]", metric, i), "no DeviceLabelMap entry for '%s'", label)
+			}
+		}
+	}
+}
+
+// mapLabels removes labels from mapping which do not exist in exporter identity,
+// and maps rest to identity label names (and values). Returns the (label,value) slice
+// as result, and list of labels missing a mapping, ignoring given generated labels
+func mapLabels(labels map[string]string, identity identityT, generated map[string]bool) ([]labelPairT, []string) {
+	missing := make([]string, 0)
+	result := make([]labelPairT, 0)
+	for label, value := range labels {
+		name, exists := identity.DeviceLabelMap[label]
+		if exists {
+			// log.Printf("device label mapping: '%s' -> '%s' = '%s'", label, name, value)
+			result = append(result, labelPairT{name, identity.DeviceLabelPrefix[label] + value})
+		} else if !generated[label] {
+			// log.Printf("missing mapping for device label '%s'", label)
+			missing = append(missing, label)
+		}
+	}
+	return result, missing
+}
+
+// getOutput is called at startup to load exporter identity from specified
+// JSON config file, and to map device info labels and metric names based on it.
+// Labels are filtered by identity at startup, but metrics only on output.
+// Latter is to make sure that metric derivation works correctly.
+// Config issues are added to given problems.
+func getOutput(info *devinfoT, idfile string, p *problemsT) outputT {
+	var identity identityT
+	if !readJSON(idfile, &identity, p) {
+		return outputT{name: idfile}
+	}
+	return mapOutput(info, idfile, identity, p)
+}
+
+// mapOutput checks given identity (from given file) and maps device info
+// labels and metric names based on it.  Config issues are added to given problems
+func mapOutput(info *devinfoT, idfile string, identity identityT, p *problemsT) outputT {
+	var out outputT
+	out.name = idfile
+	log.Printf("identity: %+v\n", identity)
+	checkIdentity(idfile, &identity, p)
+
+	devcount := len(info.deviceLabels)
+	out.deviceLabels = make([][]labelPairT, devcount)
+	for dev := 0; dev < devcount; dev++ {
+		labels, missing := mapLabels(info.deviceLabels[dev], identity, info.generated)
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			log.Printf("WARN: no '%s' identity mapping for device[%d] labels: %v", idfile, dev, missing)
+		}
+		out.deviceLabels[dev] = sortLabelList(labels)
+	}
+	// complain about missing labels and metrics
+	for _, label := range sortedKeys(identity.DeviceLabelMap) {
+		missing := 0
+		for dev := 0; dev < devcount; dev++ {
+			if _, exists := info.deviceLabels[dev][label]; !exists {
+				missing++
+			}
+		}
+		if missing > 0 {
+			p.warnf(idfile, "DeviceLabelMap."+label, "label missing from %d of %d devices", missing, devcount)
+		}
+	}
+	if info.metricLimits != nil {
+		for _, metric := range sortedKeys(identity.MetricMap) {
+			if _, exists := info.metricLimits[metric]; !exists {
+				p.warnf(idfile, "MetricMap."+metric, "no such device type metric/limit")
+			}
+		}
+	}
+	// map (matching) device metric names to output names
+	out.metrics = make(map[string]string)
+	for metric := range info.metricLimits {
+		name, exists := identity.MetricMap[metric]
+		if !exists {
+			log.Printf("WARN: no '%s' identity mapping for device metric/limit: '%s'", idfile, metric)
+			continue
+		}
+		out.metrics[name] = metric
+		log.Printf("metric/limit name '%s' identity mapping: '%s' -> '%s'", idfile, metric, name)
+	}
+	// map metric info labels
+	out.metricLabels = make(map[string][]labelPairT, len(identity.MetricLabels))
+	for metric, labels := range identity.MetricLabels {
+		name, exists := identity.MetricMap[metric]
+		if !exists {
+			continue
+		}
+		i := 0
+		ll := make([]labelPairT, len(labels))
+		for label, value := range labels {
+			ll[i] = labelPairT{label, value}
+			i++
+		}
+		out.metricLabels[name] = sortLabelList(ll)
+	}
+	// map metric output value conversions
+	out.metricConversion = make(map[string]conversionT, len(identity.MetricConversion))
+	for metric, conv := range identity.MetricConversion {
+		name, exists := identity.MetricMap[metric]
+		if !exists {
+			continue
+		}
+		if conv.Scale == 0 {
+			conv.Scale = 1
+		}
+		out.metricConversion[name] = conv
+	}
+	// map per-metric device labels
+	out.metricDeviceLabels = make(map[string]map[string]bool, len(identity.MetricDeviceLabels))
+	for metric, labels := range identity.MetricDeviceLabels {
+		name, exists := identity.MetricMap[metric]
+		if !exists {
+			continue
+		}
+		include := make(map[string]bool, len(labels))
+		for _, label := range labels {
+			if mapped, exists := identity.DeviceLabelMap[label]; exists {
+				include[mapped] = true
+			}
+		}
+		out.metricDeviceLabels[name] = include
+	}
+	out.timestamps = identity.Timestamps
+	out.labelSeparator = identity.LabelSeparator
+	if out.labelSeparator == "" {
+		out.labelSeparator = defaultLabelSeparator
+	}
+	if identity.Header != nil {
+		out.header = *identity.Header
+	} else {
+		out.header = fmt.Sprintf("# %s %s", project, version.Version)
+	}
+	for _, attr := range sortedKeys(identity.PodLabels) {
+		out.podLabels = append(out.podLabels, podLabelT{attr, identity.PodLabels[attr]})
+	}
+	// which device metrics to output
+	i := 0
+	names := make([]string, len(identity.MetricMap))
+	for _, name := range identity.MetricMap {
+		names[i] = name
+		i++
+	}
+	sort.Strings(names)
+	out.output = names
+	return out
+}
+
+// outputLabels returns device labels included for given metric,
+// followed by the metric specific labels
+func (out *outputT) outputLabels(dev int, metric string) []labelPairT {
+	include, filtered := out.metricDeviceLabels[metric]
+	labels := make([]labelPairT, 0, len(out.deviceLabels[dev])+len(out.metricLabels[metric]))
+	for _, label := range out.deviceLabels[dev] {
+		if !filtered || include[label.name] {
+			labels = append(labels, label)
+		}
+	}
+	return append(labels, out.metricLabels[metric]...)
+}
+
+// seriesLabels returns output labels for each series of given device metric.
+// If identity has pod labels, there's a series for each pod container owning
+// the device, with its labels added.  Owners differing only by attributes
+// which identity does not output, get a single series.  Needs to be called
+// with simulation mutex held
+func (out *outputT) seriesLabels(dev int, metric string) [][]labelPairT {
+	labels := out.outputLabels(dev, metric)
+	if len(out.podLabels) == 0 || dev >= len(podOwners) || len(podOwners[dev]) == 0 {
+		return [][]labelPairT{labels}
+	}
+	series := make([][]labelPairT, 0, len(podOwners[dev]))
+	seen := make(map[podOwnerT]bool, len(podOwners[dev]))
+	for _, owner := range podOwners[dev] {
+		// owner with only the output attributes
+		var key podOwnerT
+		ll := append(make([]labelPairT, 0, len(labels)+len(out.podLabels)), labels...)
+		for _, label := range out.podLabels {
+			value := owner.attr(label.attr)
+			key.setAttr(label.attr, value)
+			ll = append(ll, labelPairT{label.name, value})
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		series = append(series, ll)
+	}
+	return series
+}
+
+// outputValue returns given metric value converted for output
+func (out *outputT) outputValue(metric string, value float64) float64 {
+	if conv, exists := out.metricConversion[metric]; exists {
+		value = value*conv.Scale + conv.Offset
+		if conv.Round {
+			value = math.Round(value)
+		}
+	}
+	return value
+}
+
+// deviceValue returns current device value for given output metric,
+// and whether device has such metric
+func (out *outputT) deviceValue(dev int, metric string) (float64, bool) {
+	value, exists := device[dev][out.metrics[metric]]
+	return value, exists
+}
@@ -3,29 +3,40 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"github.com/intel/fakedev-exporter/version"
+	"github.com/intel/fakedev-exporter/wlspec"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
 	project   = "fakedev-exporter"
-	version   = "v0.1"
 	metricURL = "/metrics"
 )
 
 var (
-	// device labels, metric limits and what metrics to output
+	// device labels and metric limits
 	devinfo devinfoT
+	// per-identity output information
+	outputs []outputT
 	// [device][metric]: value
 	device []map[string]float64
 	mutex  sync.Mutex
+	// whether unknown fields in config files and WL specs are just ignored
+	allowUnknownFields bool
 )
 
 // mapDevices() maps device file name to device array index
@@ -46,6 +57,49 @@ func mapDevices(names []string) map[int]bool {
 	return devmap
 }
 
+// mapSelector() maps WL device selector to device array indexes. If selector
+// specifies device count, that many matching free devices are selected.
+// Returns also whether selection failed only because matching devices were busy
+func mapSelector(sel *wlspec.SelectorT) (map[int]bool, bool) {
+	matchers, err := sel.Matchers()
+	if err != nil {
+		log.Printf("WARN, invalid WL device selector: %v", err)
+		return nil, false
+	}
+	var users map[int]int
+	if sel.Count > 0 {
+		users = deviceUsers()
+	}
+	devmap := make(map[int]bool)
+	matching := 0
+	for dev, labels := range devinfo.deviceLabels {
+		matches := true
+		for _, m := range matchers {
+			if !m.Matches(labels) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		matching++
+		if sel.Count > 0 && !isFree(users[dev]) {
+			continue
+		}
+		devmap[dev] = true
+		if sel.Count > 0 && len(devmap) == int(sel.Count) {
+			return devmap, false
+		}
+	}
+	if sel.Count > 0 {
+		log.Printf("WARN, only %d of %d WL selector %v requested devices are free (%d match)",
+			len(devmap), sel.Count, sel.Labels, matching)
+		return nil, matching >= int(sel.Count)
+	}
+	return devmap, false
+}
+
 // runSimulation updates all metrics in devices. First it sets minimum value to
 // a metric and then asks each workload to add their own values on top of that,
 // with end result then being limited to maximum value.
@@ -53,15 +107,17 @@ func runSimulation() {
 	for dev := 0; dev < len(device); dev++ {
 		limited := make([]string, 0)
 		// TODO: use ordered metrics list instead of (random order) map
-		for metric, limit := range devinfo.metricLimits {
+		for metric, limit := range devinfo.deviceLimits[dev] {
 			value := addWorkloadsToMetric(dev, limit.Min, limit)
 			if value < limit.Min {
 				// limits differ between metrics which should help to identify them
 				limited = append(limited, fmt.Sprintf("%g < %g", value, limit.Min))
+				stats.limited[metric]++
 				value = limit.Min
 			}
 			if value > limit.Max {
 				limited = append(limited, fmt.Sprintf("%g > %g", value, limit.Max))
+				stats.limited[metric]++
 				value = limit.Max
 			}
 			device[dev][metric] = value
@@ -72,30 +128,33 @@ func runSimulation() {
 	}
 }
 
-func writeMetric(w http.ResponseWriter, dev int, metric string, mvalue float64) {
-	comma := false
-	labelSets := [][]labelPairT{
-		devinfo.deviceLabels[dev], devinfo.metricLabels[metric],
-	}
+// labelValueEscaper escapes label values as required by the text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetric writes given device metric series in text format, with
+// given labels, and timestamp (in milliseconds), if that's non-zero
+func writeMetric(w io.Writer, out *outputT, labels []labelPairT, metric string, mvalue float64, timestamp int64) {
 	fmt.Fprintf(w, "%s{", metric)
-	for _, labels := range labelSets {
-		for _, label := range labels {
-			if comma {
-				fmt.Fprintf(w, ", %s=\"%s\"", label.name, label.value)
-			} else {
-				fmt.Fprintf(w, "%s=\"%s\"", label.name, label.value)
-				comma = true
-			}
+	for i, label := range labels {
+		value := labelValueEscaper.Replace(label.value)
+		if i > 0 {
+			fmt.Fprintf(w, "%s%s=\"%s\"", out.labelSeparator, label.name, value)
+		} else {
+			fmt.Fprintf(w, "%s=\"%s\"", label.name, value)
 		}
 	}
-	fmt.Fprintf(w, "} %g\n", mvalue)
+	fmt.Fprintf(w, "} %g", out.outputValue(metric, mvalue))
+	if timestamp != 0 {
+		fmt.Fprintf(w, " %d", timestamp)
+	}
+	fmt.Fprintln(w)
 }
 
-func requestCheck(r *http.Request) int {
+func requestCheck(r *http.Request, path string) int {
 	if r.Method != http.MethodGet {
 		return http.StatusMethodNotAllowed
 	}
-	if r.URL.Path != metricURL {
+	if r.URL.Path != path {
 		return http.StatusNotFound
 	}
 	if r.Body != http.NoBody {
@@ -104,51 +163,287 @@ func requestCheck(r *http.Request) int {
 	return http.StatusOK
 }
 
-func exporter(w http.ResponseWriter, r *http.Request) {
+// simulate() runs simulation, and writes resulting metrics to given buffer
+// for given identity output in given format
+func simulate(w io.Writer, out *outputT, format formatT) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	if status := requestCheck(r); status != http.StatusOK {
-		w.WriteHeader(status)
-		return
-	}
 	// run simulation related items
 	acceptWorkloads()
 	runSimulation()
 	updateWorkloads()
 
 	// report results
-	fmt.Fprintf(w, "# %s %s\n", project, version)
+	var timestamp int64
+	if out.timestamps {
+		timestamp = time.Now().UnixMilli()
+	}
+	if format == formatProto {
+		if err := writeProtoMetrics(w, out, timestamp); err != nil {
+			log.Printf("WARN: protobuf metrics marshaling failed: %v", err)
+		}
+		return
+	}
+	if out.header != "" {
+		fmt.Fprintln(w, out.header)
+	}
 	for dev := 0; dev < len(device); dev++ {
-		for _, metric := range devinfo.output {
-			if value, exists := device[dev][metric]; exists {
-				writeMetric(w, dev, metric, value)
+		for _, metric := range out.output {
+			value, exists := out.deviceValue(dev, metric)
+			if !exists {
+				continue
+			}
+			for _, labels := range out.seriesLabels(dev, metric) {
+				writeMetric(w, out, labels, metric, value, timestamp)
 			}
 		}
 	}
 }
 
-func listenPrometheus(address string) {
-	http.HandleFunc(metricURL, exporter)
-	log.Printf("Listening on %s%s", address, metricURL)
-	log.Fatal(http.ListenAndServe(address, nil))
+// negotiateContent() returns format and its content type for given request
+func negotiateContent(r *http.Request) (formatT, string) {
+	if negotiateFormat(r.Header.Get("Accept")) == formatProto {
+		return formatProto, contentTypeProto
+	}
+	return formatText, contentTypeText
+}
+
+// updateScrapeStats() updates scrape self-metrics after a completed scrape
+func updateScrapeStats(start time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	stats.scrapes++
+	stats.duration = time.Since(start).Seconds()
+}
+
+// exporter() returns HTTP handler for device metrics in given identity output
+func exporter(out *outputT) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status := requestCheck(r, out.path); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		start := time.Now()
+		// build whole response before writing it, to know its length
+		var buf bytes.Buffer
+		format, contentType := negotiateContent(r)
+		simulate(&buf, out, format)
+		writeResponse(w, r, contentType, buf.Bytes())
+		updateScrapeStats(start)
+	}
+}
+
+// selfExporter() returns HTTP handler for exporter self-metrics on given path
+func selfExporter(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status := requestCheck(r, path); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		var buf bytes.Buffer
+		format, contentType := negotiateContent(r)
+		mutex.Lock()
+		families := selfMetrics()
+		mutex.Unlock()
+		if format == formatProto {
+			if err := writeProtoSelfMetrics(&buf, families); err != nil {
+				log.Printf("WARN: protobuf metrics marshaling failed: %v", err)
+			}
+		} else {
+			writeSelfMetrics(&buf, families)
+		}
+		writeResponse(w, r, contentType, buf.Bytes())
+	}
+}
+
+// listenPrometheus() serves metrics for all identity outputs, from their
+// own addresses and paths.  Self-metrics are served from their own path
+// on the default address, if that is given
+func listenPrometheus(address, selfPath string) {
+	muxes := make(map[string]*http.ServeMux)
+	getMux := func(addr string) *http.ServeMux {
+		if _, exists := muxes[addr]; !exists {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	for i := range outputs {
+		out := &outputs[i]
+		getMux(out.address).HandleFunc(out.path, exporter(out))
+		log.Printf("Listening on %s%s ('%s' identity)", out.address, out.path, out.name)
+	}
+	if selfPath != "" {
+		getMux(address).HandleFunc(selfPath, selfExporter(selfPath))
+		log.Printf("Listening on %s%s (self-metrics)", address, selfPath)
+	}
+	if faultPath != "" {
+		getMux(address).HandleFunc(faultPath, faultHandler(faultPath))
+		log.Printf("Listening on %s%s (device faults)", address, faultPath)
+	}
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			log.Fatal(http.ListenAndServe(addr, mux))
+		}(addr, mux)
+	}
+}
+
+// endpointsT tracks metric endpoints used by identities and self-metrics
+type endpointsT struct {
+	// default address
+	address string
+	// address+path -> identity using it
+	used map[string]string
+}
+
+func newEndpoints(address, selfPath string) *endpointsT {
+	e := endpointsT{address, make(map[string]string)}
+	if selfPath != "" {
+		e.used[address+selfPath] = "self-metrics"
+	}
+	if faultPath != "" {
+		e.used[address+faultPath] = "device faults"
+	}
+	return &e
+}
+
+// set sets given "[address]/path" endpoint for given output, if it is
+// valid and not already used. Otherwise problem is added for given source
+func (e *endpointsT) set(out *outputT, endpoint, source, path string, p *problemsT) bool {
+	slash := strings.Index(endpoint, "/")
+	if slash < 0 {
+		p.errorf(source, path, "'%s' endpoint '%s' is missing URL path", out.name, endpoint)
+		return false
+	}
+	out.address, out.path = endpoint[:slash], endpoint[slash:]
+	if out.address == "" {
+		out.address = e.address
+	}
+	if other, exists := e.used[out.address+out.path]; exists {
+		p.errorf(source, path, "'%s' endpoint '%s%s' already used by '%s'", out.name, out.address, out.path, other)
+		return false
+	}
+	e.used[out.address+out.path] = out.name
+	return true
+}
+
+// parseIdentities() parses comma separated list of identity files, each with
+// an optional "=[address]/path" endpoint for serving its metrics.  Endpoint
+// address defaults to given one, and first identity endpoint to its metricURL.
+// Issues in identities and their endpoints are added to given problems
+func parseIdentities(list, address, selfPath string, p *problemsT) []outputT {
+	result := make([]outputT, 0)
+	endpoints := newEndpoints(address, selfPath)
+	for i, item := range strings.Split(list, ",") {
+		idfile, endpoint, found := strings.Cut(item, "=")
+		if !found {
+			if i > 0 {
+				p.errorf("-identity", "", "'%s' is missing '=[address]/path' endpoint for its metrics", idfile)
+				continue
+			}
+			endpoint = metricURL
+		}
+		out := getOutput(&devinfo, idfile, p)
+		if endpoints.set(&out, endpoint, "-identity", "", p) {
+			result = append(result, out)
+		}
+	}
+	return result
 }
 
 func main() {
-	log.Printf("%s %s", project, version)
-	var devtype, devlist, idfile, address, wlEven, wlOdd, wlAll, socket string
+	// "validate" and "sysfs" subcommands take same options as the exporter itself
+	args := os.Args[1:]
+	validate := len(args) > 0 && args[0] == "validate"
+	sysfs := len(args) > 0 && args[0] == "sysfs"
+	if validate || sysfs {
+		args = args[1:]
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [validate|sysfs] [options] [WL JSON files to validate]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "With 'validate', config files given with the options and WL files given as arguments\nare only checked for problems, and exit code is non-zero if any are found.\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "With 'sysfs', fake sysfs + devfs tree for the configured devices is created under\n-sysfs-root directory, and exporter exits.\n\nOptions:\n")
+		flag.PrintDefaults()
+	}
+	var showVersion bool
+	var devtype, devlist, idfile, address, selfPath, wlEven, wlOdd, wlAll, socket, scenario string
 	var count int
 	flag.StringVar(&address, "address", ":9999", "Address to listen for metric queries")
+	flag.StringVar(&selfPath, "self-path", "", "If given, exporter self-metrics are served from this URL path (on -address)")
 	flag.IntVar(&count, "count", 1, "Number of devices (of specified type) to simulate")
-	flag.StringVar(&devtype, "devtype", "devtype.json", "Name of JSON config file for device type labels + metric limits")
-	flag.StringVar(&devlist, "devlist", "devlist.json", "Name of JSON config file for per-device instance labels")
-	flag.StringVar(&idfile, "identity", "identity.json", "Name of JSON config file for metric exporter identity")
+	flag.StringVar(&devtype, "devtype", "devtype.json", "Name of JSON (or YAML) config file for device type labels + metric limits")
+	flag.StringVar(&devlist, "devlist", "devlist.json", "Name of JSON (or YAML) config file for per-device instance labels")
+	flag.StringVar(&idfile, "identity", "identity.json", "Name of JSON (or YAML) config file for metric exporter identity. Comma separated list of files can be given for serving multiple identities, with '=[address]/path' endpoint after each file name (optional for first one)")
 	flag.StringVar(&socket, "socket", "/tmp/"+project, "Unix socket for workload communication")
-	flag.StringVar(&wlEven, "wl-even", "", "Name of JSON file specifying workload to run on even numbered devices")
-	flag.StringVar(&wlAll, "wl-all", "", "Name of JSON file specifying workload to run on all devices")
-	flag.StringVar(&wlOdd, "wl-odd", "", "Name of JSON file specifying workload to run on odd numbered devices")
-	flag.Parse()
+	flag.StringVar(&wlEven, "wl-even", "", "Name of JSON (or YAML) file specifying workload to run on even numbered devices")
+	flag.StringVar(&wlAll, "wl-all", "", "Name of JSON (or YAML) file specifying workload to run on all devices")
+	flag.StringVar(&wlOdd, "wl-odd", "", "Name of JSON (or YAML) file specifying workload to run on odd numbered devices")
+	flag.StringVar(&scenario, "scenario", "", "Name of JSON (or YAML) file specifying device types, device instances, exporter identities and base workloads, instead of the separate config file options")
+	flag.BoolVar(&allowUnknownFields, "allow-unknown-fields", false, "Just warn about unknown fields in config files and WL specs, instead of rejecting them")
+	flag.UintVar(&acceptBacklog, "accept-backlog", wlMaxBatch, "How many new WL connections can wait for next metrics query to process them, before further ones are rejected")
+	flag.UintVar(&deviceShares, "device-shares", 0, "How many (client) WLs can be allocated the same device at the same time, like device plugin would do. 0 = unlimited, 1 = exclusive devices")
+	flag.UintVar(&nodeWorkloads, "max-workloads", 0, "How many (client) WLs can be simulated at the same time, 0 = unlimited")
+	flag.BoolVar(&queueBusy, "queue-busy", false, "Queue WLs exceeding -device-shares or -max-workloads limits until they can be admitted, instead of rejecting them")
+	flag.UintVar(&queueSize, "queue-size", 0, "How many WLs can be queued with -queue-busy, before further ones are rejected. 0 = unlimited")
+	flag.StringVar(&faultPath, "fault-path", "", "If given, device faults can be listed (GET), set (PUT) and cleared (DELETE) from this URL path, with device file name given in 'device' query parameter")
+	flag.StringVar(&pluginResource, "plugin-resource", "", "If given, exporter registers to kubelet as device plugin for this extended resource name (e.g. 'gpu.intel.com/i915'), advertising simulated devices with their file names as device IDs")
+	flag.StringVar(&pluginDir, "plugin-dir", pluginapi.DevicePluginPath, "Kubelet device plugin directory, containing kubelet registration socket")
+	flag.StringVar(&pluginDevDir, "plugin-devdir", "/tmp/"+project+"-dev", "Host directory where device plugin creates fake device files for mounting them to containers")
+	flag.StringVar(&pluginDevPath, "plugin-devpath", "/dev/dri", "Container directory to which device plugin mounts fake device files")
+	flag.StringVar(&podResourcesSocket, "podresources-socket", "", "If given, devices are attributed to pods based on kubelet PodResources API from this unix socket (normally '"+podResourcesPath+"'), for identities with PodLabels")
+	flag.StringVar(&podResourcesResource, "podresources-resource", "", "Extended resource name of the simulated devices in PodResources, defaults to -plugin-resource value. Any resource if both are empty")
+	flag.StringVar(&podResourcesLabel, "podresources-label", "file", "Device label which values are used as device IDs in PodResources")
+	flag.DurationVar(&podResourcesInterval, "podresources-interval", 5*time.Second, "How often kubelet PodResources API is queried for device allocations")
+	flag.StringVar(&sysfsRoot, "sysfs-root", "/tmp/"+project+"-root", "Directory under which 'sysfs' subcommand creates fake 'sys/' and device file (-plugin-devpath) trees")
+	flag.StringVar(&sysfsVendor, "sysfs-vendor", "0x8086", "PCI vendor ID for fake sysfs devices which lack 'vendor' label")
+	flag.BoolVar(&showVersion, "version", false, "Show version and build information, and exit")
+	flag.CommandLine.Parse(args)
+	if showVersion {
+		fmt.Println(version.BuildInfo(project))
+		os.Exit(0)
+	}
+	if scenario != "" {
+		// catch options which scenario replaces
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "count", "devtype", "devlist", "identity", "wl-even", "wl-odd", "wl-all":
+				log.Fatalf("-%s option cannot be used with -scenario", f.Name)
+			}
+		})
+	}
+	if validate {
+		os.Exit(validateConfigs(scenario, count, devtype, devlist, idfile, address, selfPath,
+			append([]string{wlEven, wlOdd, wlAll}, flag.Args()...)))
+	}
+	log.Print(version.Info(project))
+	if acceptBacklog == 0 {
+		log.Fatal("-accept-backlog needs to be at least 1")
+	}
+	if selfPath != "" && !strings.HasPrefix(selfPath, "/") {
+		log.Fatalf("Invalid self-metrics path '%s', it should start with '/'", selfPath)
+	}
+	if faultPath != "" && (!strings.HasPrefix(faultPath, "/") || faultPath == selfPath) {
+		log.Fatalf("Invalid device fault path '%s', it should start with '/', and differ from self-metrics path", faultPath)
+	}
+	if pluginResource != "" && !strings.Contains(pluginResource, "/") {
+		log.Fatalf("Invalid device plugin resource name '%s', it should be in 'domain/name' format", pluginResource)
+	}
 
-	devinfo = getDevinfo(count, devtype, devlist, idfile)
+	problems := problemsT{unknownFatal: !allowUnknownFields}
+	var workloads []baseWorkloadT
+	if scenario != "" {
+		devinfo, outputs, workloads = loadScenario(scenario, address, selfPath, &problems)
+	} else {
+		devinfo = getDevinfo(count, devtype, devlist, &problems)
+		problems.check()
+		if !sysfs { // device tree does not need identities
+			outputs = parseIdentities(idfile, address, selfPath, &problems)
+		}
+	}
+	problems.check()
+	if sysfs {
+		writeSysfs()
+		os.Exit(0)
+	}
 	devcount := len(devinfo.deviceLabels)
 
 	// allocate current metric values and show device labels
@@ -156,7 +451,7 @@ func main() {
 	log.Print("Initial devinfo labels:")
 	for dev := 0; dev < devcount; dev++ {
 		log.Printf("+ [%d]", dev)
-		for _, label := range devinfo.deviceLabels[dev] {
+		for _, label := range sortedLabels(devinfo.deviceLabels[dev]) {
 			log.Printf("  - %s='%s'\n", label.name, label.value)
 		}
 		device[dev] = make(map[string]float64)
@@ -164,13 +459,27 @@ func main() {
 	loadWorkload(wlEven, devcount, func(i int) bool { return i%2 == 0 })
 	loadWorkload(wlOdd, devcount, func(i int) bool { return i%2 != 0 })
 	loadWorkload(wlAll, devcount, func(i int) bool { return true })
+	for _, wl := range workloads {
+		addWorkload(wl.spec, wl.devmap)
+	}
 
 	const umask = 07077
 	old := syscall.Umask(umask)
 	log.Printf("Umask: %04o -> %04o", old, umask)
 
+	connections = make(chan net.Conn, acceptBacklog)
 	go listenForWorkloads(socket)
-	go listenPrometheus(address)
+	if pluginResource != "" {
+		go runDevicePlugin()
+	}
+	if podResourcesSocket != "" {
+		if podResourcesResource == "" {
+			podResourcesResource = pluginResource
+		}
+		initPodResources()
+		go runPodResources()
+	}
+	listenPrometheus(address, selfPath)
 
 	// exit with 0 when asked nicely to terminate
 	sig := make(chan os.Signal, 1)
@@ -0,0 +1,152 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	podResourcesPath    = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	podResourcesTimeout = time.Second
+)
+
+// pod attributes which identities can map to output labels
+const (
+	podAttrPod       = "pod"
+	podAttrNamespace = "namespace"
+	podAttrContainer = "container"
+)
+
+// PodResources attribution options
+var (
+	// kubelet PodResources API socket, attribution is disabled if empty
+	podResourcesSocket string
+	// extended resource name for simulated devices, any if empty
+	podResourcesResource string
+	// device label which values are used as kubelet device IDs
+	podResourcesLabel string
+	// how often kubelet is queried for device allocations
+	podResourcesInterval time.Duration
+)
+
+// podOwnerT is pod container to which a device is allocated
+type podOwnerT struct {
+	pod, namespace, container string
+}
+
+// attr returns value of given pod attribute
+func (o podOwnerT) attr(name string) string {
+	switch name {
+	case podAttrPod:
+		return o.pod
+	case podAttrNamespace:
+		return o.namespace
+	case podAttrContainer:
+		return o.container
+	}
+	return ""
+}
+
+// setAttr sets value of given pod attribute
+func (o *podOwnerT) setAttr(name, value string) {
+	switch name {
+	case podAttrPod:
+		o.pod = value
+	case podAttrNamespace:
+		o.namespace = value
+	case podAttrContainer:
+		o.container = value
+	}
+}
+
+var (
+	podResourcesClient podresourcesapi.PodResourcesListerClient
+	// device ID -> device index
+	podDeviceIDs map[string]int
+	// per-device pod containers, accessed with simulation mutex held
+	podOwners [][]podOwnerT
+)
+
+// initPodResources() sets up client for kubelet PodResources API, and
+// device ID mapping for matching its device allocations to simulated devices
+func initPodResources() {
+	conn, err := grpc.Dial("unix://"+podResourcesSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Kubelet PodResources socket '%s' client setup failed: %v", podResourcesSocket, err)
+	}
+	podResourcesClient = podresourcesapi.NewPodResourcesListerClient(conn)
+	podDeviceIDs = make(map[string]int, len(devinfo.deviceLabels))
+	for dev, labels := range devinfo.deviceLabels {
+		id, exists := labels[podResourcesLabel]
+		if !exists {
+			log.Fatalf("Device-%d lacks '%s' label used as device ID for PodResources", dev, podResourcesLabel)
+		}
+		podDeviceIDs[id] = dev
+	}
+	podOwners = make([][]podOwnerT, len(devinfo.deviceLabels))
+	log.Printf("Attributing devices to pods, based on kubelet PodResources from '%s'", podResourcesSocket)
+}
+
+// updatePodOwners() queries kubelet for device allocations, and updates
+// pod containers owning the simulated devices.  On failure, previous
+// information is kept.  Needs to be called without simulation mutex
+func updatePodOwners() {
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	resp, err := podResourcesClient.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		log.Printf("WARN, kubelet PodResources query failed: %v", err)
+		mutex.Lock()
+		stats.podQueryErrors++
+		mutex.Unlock()
+		return
+	}
+	owners := make([][]podOwnerT, len(devinfo.deviceLabels))
+	for _, pod := range resp.PodResources {
+		for _, container := range pod.Containers {
+			owner := podOwnerT{pod.Name, pod.Namespace, container.Name}
+			for _, devices := range container.Devices {
+				if podResourcesResource != "" && devices.ResourceName != podResourcesResource {
+					continue
+				}
+				for _, id := range devices.DeviceIds {
+					if dev, exists := podDeviceIDs[id]; exists {
+						owners[dev] = append(owners[dev], owner)
+					}
+				}
+			}
+		}
+	}
+	mutex.Lock()
+	podOwners = owners
+	mutex.Unlock()
+}
+
+// runPodResources() updates pod owners of the simulated devices at
+// podResourcesInterval, so that slow kubelet does not delay metrics
+// queries.  Does not return
+func runPodResources() {
+	for {
+		updatePodOwners()
+		time.Sleep(podResourcesInterval)
+	}
+}
+
+// attributedDevices() returns number of devices allocated to pods.
+// Needs to be called with simulation mutex held
+func attributedDevices() int {
+	count := 0
+	for _, owners := range podOwners {
+		if len(owners) > 0 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,233 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/intel/fakedev-exporter/yamljson"
+)
+
+// problemT is a config file issue, with JSON path to the offending item
+type problemT struct {
+	file, path, msg string
+	fatal           bool
+}
+
+func (p problemT) String() string {
+	level := "WARN"
+	if p.fatal {
+		level = "ERROR"
+	}
+	if p.path == "" {
+		return fmt.Sprintf("%s: %s: %s", p.file, level, p.msg)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", p.file, p.path, level, p.msg)
+}
+
+// problemsT collects config file issues, so that all of them can be
+// reported at once, instead of stopping to first one
+type problemsT struct {
+	list []problemT
+	// whether unknown config fields are errors instead of warnings
+	unknownFatal bool
+	// JSON path prefix for problems, when config is part of a larger file
+	prefix string
+}
+
+// fullPath returns given JSON path with current path prefix
+func (p *problemsT) fullPath(path string) string {
+	if p.prefix == "" || strings.HasPrefix(path, "[") {
+		return p.prefix + path
+	}
+	if path == "" {
+		return p.prefix
+	}
+	return p.prefix + "." + path
+}
+
+// errorf adds problem that prevents using the given config file
+func (p *problemsT) errorf(file, path, format string, args ...any) {
+	p.list = append(p.list, problemT{file, p.fullPath(path), fmt.Sprintf(format, args...), true})
+}
+
+// warnf adds problem for config file content which is likely to be a mistake
+func (p *problemsT) warnf(file, path, format string, args ...any) {
+	p.list = append(p.list, problemT{file, p.fullPath(path), fmt.Sprintf(format, args...), false})
+}
+
+// errorCount returns number of fatal problems
+func (p *problemsT) errorCount() int {
+	count := 0
+	for _, problem := range p.list {
+		if problem.fatal {
+			count++
+		}
+	}
+	return count
+}
+
+// check logs collected problems and clears them, and exits if any
+// of them was fatal
+func (p *problemsT) check() {
+	for _, problem := range p.list {
+		log.Print(problem)
+	}
+	if count := p.errorCount(); count > 0 {
+		log.Fatalf("%d config file error(s), exiting", count)
+	}
+	p.list = nil
+}
+
+// write writes collected problems to given writer, one per line
+func (p *problemsT) write(w io.Writer) {
+	for _, problem := range p.list {
+		fmt.Fprintln(w, problem)
+	}
+}
+
+// readJSON reads and unmarshals given JSON (or YAML) config file to target,
+// adding problems for any issues.  Returns false if target is unusable
+func readJSON(file string, target any, p *problemsT) bool {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		p.errorf(file, "", "read failed: %v", err)
+		return false
+	}
+	if text, err = yamljson.ToJSON(file, text); err != nil {
+		p.errorf(file, "", "invalid YAML: %v", err)
+		return false
+	}
+	return parseJSON(file, text, target, p)
+}
+
+// parseJSON unmarshals given JSON text to target, adding problems for
+// any issues, with source name.  Returns false if target is unusable
+func parseJSON(source string, text []byte, target any, p *problemsT) bool {
+	if err := json.Unmarshal(text, target); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			line, col := textPosition(text, syntaxErr.Offset)
+			p.errorf(source, "", "invalid JSON at line %d, column %d: %v", line, col, err)
+		case errors.As(err, &typeErr):
+			p.errorf(source, typeErr.Field, "JSON %s value where %v is expected", typeErr.Value, typeErr.Type)
+		default:
+			p.errorf(source, "", "JSON unmarshaling failed: %v", err)
+		}
+		return false
+	}
+	var value any
+	if err := json.Unmarshal(text, &value); err != nil {
+		return true
+	}
+	for _, path := range unknownFields("", value, reflect.TypeOf(target)) {
+		if p.unknownFatal {
+			p.errorf(source, path, "unknown field")
+		} else {
+			p.warnf(source, path, "unknown field (ignored)")
+		}
+	}
+	return true
+}
+
+// textPosition returns line and column numbers for given text offset
+func textPosition(text []byte, offset int64) (int, int) {
+	if offset > int64(len(text)) {
+		offset = int64(len(text))
+	}
+	before := text[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// jsonFields returns mapping of lower-cased JSON member names to their
+// struct fields, for matching them case-insensitively like encoding/json
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	return fields
+}
+
+// unknownFields walks given unmarshaled JSON value along with the Go type
+// it was unmarshaled to, and returns JSON paths for object members which
+// did not match any struct field, i.e. which were ignored by unmarshaling
+func unknownFields(path string, value any, t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	unknown := make([]string, 0)
+	member := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			break
+		}
+		fields := jsonFields(t)
+		for _, name := range sortedKeys(object) {
+			field, exists := fields[strings.ToLower(name)]
+			if !exists {
+				unknown = append(unknown, member(name))
+				continue
+			}
+			unknown = append(unknown, unknownFields(member(name), object[name], field.Type)...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, name := range sortedKeys(object) {
+			unknown = append(unknown, unknownFields(member(name), object[name], t.Elem())...)
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]any)
+		if !ok {
+			break
+		}
+		for i, item := range list {
+			unknown = append(unknown, unknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	}
+	return unknown
+}
+
+// sortedKeys returns JSON object member (or other map) names in sorted order
+func sortedKeys[T any](object map[string]T) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+type formatT int
+
+const (
+	formatText formatT = iota
+	formatProto
+)
+
+const (
+	contentTypeText  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeProto = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+)
+
+// negotiateFormat() returns metric exposition format to use for
+// given Accept header value.  Delimited protobuf format is used
+// only when client prefers it at least as much as text format
+func negotiateFormat(header string) formatT {
+	var qText, qProto float64
+	for _, item := range strings.Split(header, ",") {
+		media, params, err := mime.ParseMediaType(item)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, exists := params["q"]; exists {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch media {
+		case "application/vnd.google.protobuf":
+			if params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited" {
+				qProto = max(qProto, q)
+			}
+		case "text/plain", "text/*", "*/*":
+			qText = max(qText, q)
+		}
+	}
+	if qProto > 0 && qProto >= qText {
+		return formatProto
+	}
+	return formatText
+}
+
+// metricLabels() returns given output labels as protobuf label pairs
+func metricLabels(labels []labelPairT) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, &dto.LabelPair{
+			Name:  proto.String(label.name),
+			Value: proto.String(label.value),
+		})
+	}
+	return pairs
+}
+
+// writeProtoMetrics() writes same metrics as text output, but grouped
+// into metric families, in length delimited protobuf format.  Timestamp
+// (in milliseconds) is added to the metrics, if it's non-zero
+func writeProtoMetrics(w io.Writer, out *outputT, timestamp int64) error {
+	for _, metric := range out.output {
+		family := &dto.MetricFamily{
+			Name: proto.String(metric),
+			Type: dto.MetricType_UNTYPED.Enum(),
+		}
+		for dev := 0; dev < len(device); dev++ {
+			value, exists := out.deviceValue(dev, metric)
+			if !exists {
+				continue
+			}
+			for _, labels := range out.seriesLabels(dev, metric) {
+				m := &dto.Metric{
+					Label:   metricLabels(labels),
+					Untyped: &dto.Untyped{Value: proto.Float64(out.outputValue(metric, value))},
+				}
+				if timestamp != 0 {
+					m.TimestampMs = proto.Int64(timestamp)
+				}
+				family.Metric = append(family.Metric, m)
+			}
+		}
+		if len(family.Metric) == 0 {
+			continue
+		}
+		if _, err := protodelim.MarshalTo(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProtoSelfMetrics() writes given self-metric families
+// in length delimited protobuf format
+func writeProtoSelfMetrics(w io.Writer, families []selfFamilyT) error {
+	for _, family := range families {
+		mf := &dto.MetricFamily{
+			Name: proto.String(family.name),
+			Help: proto.String(family.help),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		if family.counter {
+			mf.Type = dto.MetricType_COUNTER.Enum()
+		}
+		for _, sample := range family.samples {
+			m := &dto.Metric{}
+			for _, label := range sample.labels {
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(label.name),
+					Value: proto.String(label.value),
+				})
+			}
+			if family.counter {
+				m.Counter = &dto.Counter{Value: proto.Float64(sample.value)}
+			} else {
+				m.Gauge = &dto.Gauge{Value: proto.Float64(sample.value)}
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+		if len(mf.Metric) == 0 {
+			continue
+		}
+		if _, err := protodelim.MarshalTo(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
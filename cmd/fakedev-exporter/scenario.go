@@ -0,0 +1,257 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/intel/fakedev-exporter/wlspec"
+)
+
+// scenarioT bundles everything needed for simulation into a single file:
+// device types, device instances, exporter identities and base workloads
+type scenarioT struct {
+	// device type name -> its labels and metric limits
+	DeviceTypes map[string]devtypeT
+	// device groups, devices are indexed in the listed order
+	Devices []deviceGroupT
+	// exporter identities, and endpoints from which they are served
+	Identities []scenarioIdentityT
+	// base WLs, and devices on which they are run
+	Workloads []scenarioWorkloadT
+}
+
+// deviceGroupT specifies given number of devices of given type
+type deviceGroupT struct {
+	// name of the device type
+	Type string
+	// number of devices, defaults to DeviceLabels count
+	Count int
+	// same as in devlist
+	DeviceLabels []map[string]string
+	Generator    *generatorT
+}
+
+// scenarioIdentityT is identity with an "[address]/path" endpoint for
+// its metrics.  Endpoint is optional for the first one
+type scenarioIdentityT struct {
+	Endpoint string
+	Identity identityT
+}
+
+// scenarioWorkloadT is base WL spec, with placement for its devices
+type scenarioWorkloadT struct {
+	Select placementT
+	Spec   wlspec.SpecT
+}
+
+// placementT places base WL on devices matching all of the specified
+// conditions.  Unlike WL spec device selector (wlspec.SelectorT), it's
+// resolved at startup, and can use device indices.  Empty placement
+// matches all devices
+type placementT struct {
+	// comma separated list of device indexes and index ranges, e.g. "0-3,8"
+	Indices string
+	// device label name -> glob pattern for its value
+	Labels map[string]string
+	// if non-zero, device index % Modulo needs to equal Remainder
+	Modulo    int
+	Remainder int
+}
+
+// isEmpty returns true if placement has no conditions
+func (pl *placementT) isEmpty() bool {
+	return pl.Indices == "" && len(pl.Labels) == 0 && pl.Modulo == 0
+}
+
+// baseWorkloadT is WL spec JSON with devices it should be run on
+type baseWorkloadT struct {
+	spec   []byte
+	devmap map[int]bool
+}
+
+// parseIndices returns set of device indexes in given index list,
+// or error if they're invalid or not within device count
+func parseIndices(list string, devcount int) (map[int]bool, error) {
+	indices := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 0 || end < start {
+			return nil, fmt.Errorf("invalid index (range) '%s'", item)
+		}
+		if end >= devcount {
+			return nil, fmt.Errorf("index (range) '%s' is not within device count (%d)", item, devcount)
+		}
+		for i := start; i <= end; i++ {
+			indices[i] = true
+		}
+	}
+	return indices, nil
+}
+
+// placeDevices returns devices matching given placement, or error
+// if placement is invalid
+func placeDevices(sel placementT, info *devinfoT) (map[int]bool, error) {
+	devcount := len(info.deviceLabels)
+	var indices map[int]bool
+	if sel.Indices != "" {
+		var err error
+		if indices, err = parseIndices(sel.Indices, devcount); err != nil {
+			return nil, err
+		}
+	}
+	if sel.Modulo < 0 || (sel.Modulo > 0 && (sel.Remainder < 0 || sel.Remainder >= sel.Modulo)) {
+		return nil, fmt.Errorf("invalid Modulo %d / Remainder %d", sel.Modulo, sel.Remainder)
+	}
+	for label, pattern := range sel.Labels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid '%s' label pattern '%s': %v", label, pattern, err)
+		}
+	}
+	devmap := make(map[int]bool)
+	for dev := 0; dev < devcount; dev++ {
+		if indices != nil && !indices[dev] {
+			continue
+		}
+		if sel.Modulo > 0 && dev%sel.Modulo != sel.Remainder {
+			continue
+		}
+		matches := true
+		for label, pattern := range sel.Labels {
+			value, exists := info.deviceLabels[dev][label]
+			if ok, _ := path.Match(pattern, value); !exists || !ok {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			devmap[dev] = true
+		}
+	}
+	return devmap, nil
+}
+
+// loadScenario loads device info, identity outputs and base WLs from given
+// scenario (JSON or YAML) file.  Metric endpoint address defaults to given one,
+// and given self-metrics path cannot be used by identities.  Config issues
+// are added to given problems
+func loadScenario(file, address, selfPath string, p *problemsT) (devinfoT, []outputT, []baseWorkloadT) {
+	var (
+		scenario  scenarioT
+		info      devinfoT
+		outputs   []outputT
+		workloads []baseWorkloadT
+	)
+	if !readJSON(file, &scenario, p) {
+		return info, outputs, workloads
+	}
+	for _, name := range sortedKeys(scenario.DeviceTypes) {
+		p.prefix = "DeviceTypes." + name
+		checkLimits(file, scenario.DeviceTypes[name].MetricLimits, p)
+	}
+	devicesOK := len(scenario.Devices) > 0
+	if !devicesOK {
+		p.prefix = ""
+		p.errorf(file, "Devices", "no devices specified")
+	}
+	for i, group := range scenario.Devices {
+		p.prefix = fmt.Sprintf("Devices[%d]", i)
+		devtype, exists := scenario.DeviceTypes[group.Type]
+		if !exists {
+			p.errorf(file, "Type", "unknown device type '%s'", group.Type)
+			devicesOK = false
+			continue
+		}
+		count := group.Count
+		if count == 0 {
+			count = len(group.DeviceLabels)
+		}
+		if count <= 0 {
+			p.errorf(file, "Count", "no devices in the group")
+			devicesOK = false
+			continue
+		}
+		devlist := devlistT{DeviceLabels: group.DeviceLabels, Generator: group.Generator}
+		if !info.addDevices(devtype, devlist, count, file, p) {
+			devicesOK = false
+		}
+	}
+	p.prefix = ""
+	if !devicesOK {
+		info.deviceLabels, info.deviceLimits = nil, nil
+	}
+
+	if len(scenario.Identities) == 0 {
+		p.errorf(file, "Identities", "no exporter identities specified")
+	}
+	endpoints := newEndpoints(address, selfPath)
+	for i, item := range scenario.Identities {
+		p.prefix = fmt.Sprintf("Identities[%d]", i)
+		endpoint := item.Endpoint
+		if endpoint == "" {
+			if i > 0 {
+				p.errorf(file, "Endpoint", "missing '[address]/path' endpoint for identity metrics")
+				continue
+			}
+			endpoint = metricURL
+		}
+		p.prefix += ".Identity"
+		out := mapOutput(&info, file, item.Identity, p)
+		out.name = fmt.Sprintf("%s:%s", file, p.prefix)
+		p.prefix = fmt.Sprintf("Identities[%d]", i)
+		if endpoints.set(&out, endpoint, file, "Endpoint", p) {
+			outputs = append(outputs, out)
+		}
+	}
+
+	for i, wl := range scenario.Workloads {
+		p.prefix = fmt.Sprintf("Workloads[%d]", i)
+		for _, problem := range wl.Spec.Problems() {
+			p.errorf(file, "Spec."+problem.Path, "%s", problem.Msg)
+		}
+		if info.deviceLabels == nil {
+			continue
+		}
+		for j, name := range wl.Spec.Devices {
+			if _, exists := info.devicemap[name]; !exists {
+				p.errorf(file, fmt.Sprintf("Spec.Devices[%d]", j), "no device with '%s' file name", name)
+			}
+		}
+		for _, metric := range sortedKeys(wl.Spec.Limits) {
+			if _, exists := info.metricLimits[metric]; !exists {
+				p.warnf(file, "Spec.Limits."+metric, "no such device type metric")
+			}
+		}
+		// spec devices would silently override placement
+		if !wl.Select.isEmpty() && (len(wl.Spec.Devices) > 0 || wl.Spec.Selector != nil) {
+			p.errorf(file, "Select", "both Select and Spec.Devices / Spec.Selector given")
+			continue
+		}
+		devmap, err := placeDevices(wl.Select, &info)
+		if err != nil {
+			p.errorf(file, "Select", "%v", err)
+			continue
+		}
+		if len(devmap) == 0 && len(wl.Spec.Devices) == 0 && wl.Spec.Selector == nil {
+			p.errorf(file, "Select", "no devices match the placement")
+			continue
+		}
+		spec, err := json.Marshal(wl.Spec)
+		if err != nil {
+			log.Fatalf("WL spec marshaling failed: %v", err)
+		}
+		workloads = append(workloads, baseWorkloadT{spec, devmap})
+	}
+	p.prefix = ""
+	return info, outputs, workloads
+}
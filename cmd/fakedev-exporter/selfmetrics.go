@@ -0,0 +1,197 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/intel/fakedev-exporter/version"
+)
+
+const selfPrefix = "fakedev_exporter_"
+
+// reasons for WL rejection and removal, used as self-metric label values
+const (
+	rejectRead        = "read"
+	rejectUnmarshal   = "unmarshal"
+	rejectInvalid     = "invalid"
+	rejectDevices     = "devices"
+	rejectBusy        = "busy"
+	rejectNodeLimit   = "node-limit"
+	rejectQueueFull   = "queue-full"
+	rejectBacklogFull = "backlog-full"
+
+	endCompleted    = "completed"
+	endCancelled    = "cancelled"
+	endDisconnected = "disconnected"
+
+	// in addition to cancel and disconnect
+	dequeueStarted  = "started"
+	dequeueRejected = "rejected"
+)
+
+// selfStatsT stores counters for exporter self-instrumentation metrics.
+// These are accessed only with the simulation mutex held
+type selfStatsT struct {
+	added          uint64
+	rejected       map[string]uint64 // per reason
+	ended          map[string]uint64 // per reason
+	queued         uint64
+	dequeued       map[string]uint64 // per reason
+	limited        map[string]uint64 // per metric
+	scrapes        uint64
+	duration       float64 // last scrape duration, in seconds
+	podQueryErrors uint64  // failed kubelet PodResources queries
+}
+
+var (
+	// known reasons are listed, so that their series exist from start
+	stats = selfStatsT{
+		rejected: map[string]uint64{rejectRead: 0, rejectUnmarshal: 0, rejectInvalid: 0, rejectDevices: 0, rejectBusy: 0, rejectNodeLimit: 0, rejectQueueFull: 0},
+		ended:    map[string]uint64{endCompleted: 0, endCancelled: 0, endDisconnected: 0},
+		dequeued: map[string]uint64{dequeueStarted: 0, dequeueRejected: 0, endCancelled: 0, endDisconnected: 0},
+		limited:  make(map[string]uint64),
+	}
+	// updated from the workload socket listener
+	acceptErrors   atomic.Uint64
+	backlogRejects atomic.Uint64
+)
+
+type selfSampleT struct {
+	labels []labelPairT
+	value  float64
+}
+
+type selfFamilyT struct {
+	name    string
+	help    string
+	counter bool
+	samples []selfSampleT
+}
+
+// labeledSamples() returns samples for given per-label-value counters, sorted by value
+func labeledSamples(label string, counters map[string]uint64) []selfSampleT {
+	samples := make([]selfSampleT, 0, len(counters))
+	for value, count := range counters {
+		samples = append(samples, selfSampleT{[]labelPairT{{label, value}}, float64(count)})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels[0].value < samples[j].labels[0].value })
+	return samples
+}
+
+// selfMetrics() returns exporter self-instrumentation metric families.
+// Needs to be called with simulation mutex held
+func selfMetrics() []selfFamilyT {
+	rejected := make(map[string]uint64, len(stats.rejected)+1)
+	for reason, count := range stats.rejected {
+		rejected[reason] = count
+	}
+	rejected[rejectBacklogFull] = backlogRejects.Load()
+	return []selfFamilyT{{
+		name: selfPrefix + "build_info",
+		help: "Build information, with constant value 1",
+		samples: []selfSampleT{{[]labelPairT{
+			{"branch", version.Branch},
+			{"goversion", version.Go()},
+			{"revision", version.Revision},
+			{"version", version.Version},
+		}, 1}},
+	}, {
+		name:    selfPrefix + "workloads",
+		help:    "Number of currently simulated workloads",
+		samples: []selfSampleT{{nil, float64(len(workload))}},
+	}, {
+		name:    selfPrefix + "workloads_queue_depth",
+		help:    "Number of workloads queued for admission, per reason for waiting",
+		samples: labeledSamples("reason", queueDepth()),
+	}, {
+		name:    selfPrefix + "workloads_queue_oldest_seconds",
+		help:    "How long the oldest queued workload has waited for admission",
+		samples: []selfSampleT{{nil, oldestQueued()}},
+	}, {
+		name:    selfPrefix + "workloads_queued_total",
+		help:    "Number of workloads queued for admission",
+		counter: true,
+		samples: []selfSampleT{{nil, float64(stats.queued)}},
+	}, {
+		name:    selfPrefix + "workloads_dequeued_total",
+		help:    "Number of workloads removed from admission queue, per reason",
+		counter: true,
+		samples: labeledSamples("reason", stats.dequeued),
+	}, {
+		name:    selfPrefix + "workloads_added_total",
+		help:    "Number of workloads accepted for simulation",
+		counter: true,
+		samples: []selfSampleT{{nil, float64(stats.added)}},
+	}, {
+		name:    selfPrefix + "workloads_rejected_total",
+		help:    "Number of workloads rejected, per reason",
+		counter: true,
+		samples: labeledSamples("reason", rejected),
+	}, {
+		name:    selfPrefix + "workloads_ended_total",
+		help:    "Number of workloads removed from simulation, per reason",
+		counter: true,
+		samples: labeledSamples("reason", stats.ended),
+	}, {
+		name:    selfPrefix + "metric_limited_total",
+		help:    "Number of times simulated device metric value needed limiting to its min-max range",
+		counter: true,
+		samples: labeledSamples("metric", stats.limited),
+	}, {
+		name:    selfPrefix + "socket_accept_errors_total",
+		help:    "Number of workload socket accept errors",
+		counter: true,
+		samples: []selfSampleT{{nil, float64(acceptErrors.Load())}},
+	}, {
+		name:    selfPrefix + "devices_faulted",
+		help:    "Number of devices with an injected fault",
+		samples: []selfSampleT{{nil, float64(len(faulted))}},
+	}, {
+		name:    selfPrefix + "pod_attributed_devices",
+		help:    "Number of devices allocated to pods, according to kubelet PodResources",
+		samples: []selfSampleT{{nil, float64(attributedDevices())}},
+	}, {
+		name:    selfPrefix + "podresources_errors_total",
+		help:    "Number of failed kubelet PodResources queries",
+		counter: true,
+		samples: []selfSampleT{{nil, float64(stats.podQueryErrors)}},
+	}, {
+		name:    selfPrefix + "scrapes_total",
+		help:    "Number of completed metric scrapes",
+		counter: true,
+		samples: []selfSampleT{{nil, float64(stats.scrapes)}},
+	}, {
+		name:    selfPrefix + "last_scrape_duration_seconds",
+		help:    "Duration of the last completed metric scrape",
+		samples: []selfSampleT{{nil, stats.duration}},
+	}}
+}
+
+// writeSelfMetrics() writes given self-metric families in text format
+func writeSelfMetrics(w io.Writer, families []selfFamilyT) {
+	for _, family := range families {
+		mtype := "gauge"
+		if family.counter {
+			mtype = "counter"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, mtype)
+		for _, sample := range family.samples {
+			fmt.Fprint(w, family.name)
+			for i, label := range sample.labels {
+				sep := ", "
+				if i == 0 {
+					sep = "{"
+				}
+				fmt.Fprintf(w, "%s%s=\"%s\"", sep, label.name, labelValueEscaper.Replace(label.value))
+			}
+			if len(sample.labels) > 0 {
+				fmt.Fprint(w, "}")
+			}
+			fmt.Fprintf(w, " %g\n", sample.value)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	sysfsClass      = "0x030000" // PCI display controller (VGA) class
+	sysfsDRMMajor   = 226        // DRM device major number
+	sysfsRenderBase = 128        // DRM render node minor for card0
+)
+
+// fake sysfs tree options
+var (
+	// root directory under which fake sysfs + devfs tree is created
+	sysfsRoot string
+	// PCI vendor ID for devices without "vendor" label
+	sysfsVendor string
+)
+
+// writeTreeFile() creates given file, with its directory, and writes
+// given content to it
+func writeTreeFile(path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Creating directory for '%s' failed: %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		log.Fatalf("Writing '%s' failed: %v", path, err)
+	}
+}
+
+// linkTreeFile() creates (or replaces) symlink with given (relative) target,
+// along with the symlink directory
+func linkTreeFile(target, path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Creating directory for '%s' failed: %v", path, err)
+	}
+	os.Remove(path)
+	if err := os.Symlink(target, path); err != nil {
+		log.Fatalf("Symlinking '%s' -> '%s' failed: %v", path, target, err)
+	}
+}
+
+// drmNodeT is DRM device node, minor is negative for non-DRM names
+type drmNodeT struct {
+	kind, name string
+	minor      int
+}
+
+// drmNodes returns DRM card node for given device file name, and if it's
+// "cardN" name, also matching render node
+func drmNodes(file string) []drmNodeT {
+	var n int
+	if _, err := fmt.Sscanf(file, "card%d", &n); err != nil || fmt.Sprintf("card%d", n) != file {
+		return []drmNodeT{{"card", file, -1}}
+	}
+	return []drmNodeT{
+		{"card", file, n},
+		{"render", fmt.Sprintf("renderD%d", sysfsRenderBase+n), sysfsRenderBase + n},
+	}
+}
+
+// writeSysfsDevice() creates fake sysfs PCI device directory for given device
+// labels (already checked by writeSysfs()) and its parsed PCI address, with
+// DRM class entries for its device file (and render node), and their devfs
+// device files, under sysfsRoot
+func writeSysfsDevice(dev int, labels map[string]string, addr pciAddrT) {
+	file := labels["file"]
+	vendor, exists := labels["vendor"]
+	if !exists {
+		vendor = sysfsVendor
+	}
+	class, exists := labels["class"]
+	if !exists {
+		class = sysfsClass
+	}
+	// sys/devices/pciDDDD:BB/<addr>/ contains PCI device attributes
+	bus := fmt.Sprintf("pci%04x:%02x", addr.domain, addr.bus)
+	pcidev := filepath.Join("devices", bus, labels["addr"])
+	sys := filepath.Join(sysfsRoot, "sys")
+	writeTreeFile(filepath.Join(sys, pcidev, "vendor"), vendor+"\n")
+	writeTreeFile(filepath.Join(sys, pcidev, "device"), labels["pciid"]+"\n")
+	writeTreeFile(filepath.Join(sys, pcidev, "class"), class+"\n")
+	linkTreeFile(filepath.Join("..", "..", "..", pcidev), filepath.Join(sys, "bus", "pci", "devices", labels["addr"]))
+
+	// DRM class entries, with "device" link back to PCI device,
+	// and their device files, with PCI address based links to them
+	devdir := filepath.Join(sysfsRoot, pluginDevPath)
+	for _, node := range drmNodes(file) {
+		drm := filepath.Join(pcidev, "drm", node.name)
+		if node.minor >= 0 {
+			writeTreeFile(filepath.Join(sys, drm, "dev"), fmt.Sprintf("%d:%d\n", sysfsDRMMajor, node.minor))
+		}
+		linkTreeFile(filepath.Join("..", ".."), filepath.Join(sys, drm, "device"))
+		linkTreeFile(filepath.Join("..", "..", drm), filepath.Join(sys, "class", "drm", node.name))
+		writeTreeFile(filepath.Join(devdir, node.name), "")
+		linkTreeFile(filepath.Join("..", node.name), filepath.Join(devdir, "by-path", fmt.Sprintf("pci-%s-%s", labels["addr"], node.kind)))
+	}
+	log.Printf("Device-%d ('%s'): %s PCI device %s:%s at %s", dev, file, class, vendor, labels["pciid"], labels["addr"])
+}
+
+// writeSysfs() creates fake sysfs + devfs tree for the simulated devices under
+// sysfsRoot, so that programs checking them (e.g. node labelers and device
+// plugins) see the same devices as the exporter simulates
+func writeSysfs() {
+	// check labels before writing anything, so that tree is not left half-built
+	addrs := make(map[string]int, len(devinfo.deviceLabels))
+	parsed := make([]pciAddrT, len(devinfo.deviceLabels))
+	for dev, labels := range devinfo.deviceLabels {
+		for _, label := range []string{"file", "pciid", "addr"} {
+			if _, exists := labels[label]; !exists {
+				log.Fatalf("Device-%d ('%s') lacks '%s' label needed for its sysfs entries", dev, labels["file"], label)
+			}
+		}
+		addr := labels["addr"]
+		var err error
+		if parsed[dev], err = parsePCIAddr(addr); err != nil {
+			log.Fatalf("Device-%d ('%s'): %v", dev, labels["file"], err)
+		}
+		if prev, exists := addrs[addr]; exists {
+			log.Fatalf("Device-%d PCI address '%s' duplicates device-%d one", dev, addr, prev)
+		}
+		addrs[addr] = dev
+	}
+	for dev, labels := range devinfo.deviceLabels {
+		writeSysfsDevice(dev, labels, parsed[dev])
+	}
+	log.Printf("Fake sysfs + devfs tree for %d devices created under '%s'", len(devinfo.deviceLabels), sysfsRoot)
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/intel/fakedev-exporter/wlspec"
+)
+
+// validateWorkload adds problems for given WL JSON file, including
+// device file names and limit metrics not matching device info
+func validateWorkload(file string, p *problemsT) {
+	var spec wlspec.SpecT
+	if !readJSON(file, &spec, p) {
+		return
+	}
+	for _, problem := range spec.Problems() {
+		p.errorf(file, problem.Path, "%s", problem.Msg)
+	}
+	if devinfo.devicemap != nil {
+		for i, name := range spec.Devices {
+			if _, exists := devinfo.devicemap[name]; !exists {
+				p.errorf(file, fmt.Sprintf("Devices[%d]", i), "no device with '%s' file name", name)
+			}
+		}
+	}
+	if devinfo.metricLimits != nil {
+		for _, metric := range sortedKeys(spec.Limits) {
+			if _, exists := devinfo.metricLimits[metric]; !exists {
+				p.warnf(file, "Limits."+metric, "no such device type metric")
+			}
+		}
+	}
+}
+
+// validateConfigs loads given scenario, or device, identity and WL config files
+// the same way as exporter does, writes all problems found in them to stdout,
+// and returns exit code: 0 if there were none, 1 otherwise
+func validateConfigs(scenario string, count int, devtype, devlist, identities, address, selfPath string, workloads []string) int {
+	// normal startup output would just obscure the problems
+	log.SetOutput(io.Discard)
+	p := problemsT{unknownFatal: !allowUnknownFields}
+
+	if scenario != "" {
+		devinfo, _, _ = loadScenario(scenario, address, selfPath, &p)
+	} else {
+		devinfo = getDevinfo(count, devtype, devlist, &p)
+		parseIdentities(identities, address, selfPath, &p)
+	}
+	for _, file := range workloads {
+		if file != "" {
+			validateWorkload(file, &p)
+		}
+	}
+	p.write(os.Stdout)
+	if len(p.list) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found, %d of them errors\n", len(p.list), p.errorCount())
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "No problems found")
+	return 0
+}
@@ -6,35 +6,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"sort"
+	"sync"
 	"time"
+
+	"github.com/intel/fakedev-exporter/wlspec"
+	"github.com/intel/fakedev-exporter/yamljson"
 )
 
 const (
-	wlExitOK    = "0"
-	wlExitError = "1"
-	wlMaxBatch  = 16 // how many WLs k8s could normally schedule between queries
+	wlExitOK        = "0"      // errors are replied with wlspec.ErrorReply()
+	wlExitCancelled = "2"      // acknowledgement for WL cancel message
+	wlCancel        = "cancel" // message from WL terminated before its profile ended
+	wlMaxBatch      = 16       // how many WLs k8s could normally schedule between queries
+	wlMaxSpec       = 64 << 10 // max WL spec JSON size, in bytes
 )
 
-// wlProfileT values are in percents and seconds
-type wlProfileT struct {
-	Load        int
-	Fluctuation int
-	Seconds     uint
-}
-
-type workloadInfoT struct {
-	Name    string
-	Repeat  uint
-	Profile []wlProfileT
-	Devices []string
-	Limits  map[string]float64
-}
-
 // devProfileT values are ratios against device range, deadline,
 // and seconds since activity start
 type devProfileT struct {
@@ -44,9 +36,22 @@ type devProfileT struct {
 	seconds     time.Duration // time offset for looping
 }
 
+// clientT is (client) WL connection.  Its watcher go routine notices WL
+// cancel and disconnect when they happen, and acknowledges cancel without
+// waiting for the next metrics query
+type clientT struct {
+	conn net.Conn
+	// connection data after WL spec
+	rest  io.Reader
+	mutex sync.Mutex
+	// why connection ended, empty while it's active
+	end string
+}
+
 type workloadT struct {
 	name     string
-	conn     net.Conn
+	metadata wlspec.MetadataT
+	client   *clientT
 	activity int
 	repeat   uint
 	profile  []devProfileT
@@ -54,34 +59,66 @@ type workloadT struct {
 }
 
 var (
-	workload    []workloadT   = make([]workloadT, 0)
-	connections chan net.Conn = make(chan net.Conn, wlMaxBatch)
+	workload    []workloadT = make([]workloadT, 0)
+	connections chan net.Conn
 )
 
-func addWorkload(text []byte, devmap map[int]bool, conn net.Conn) bool {
-	var (
-		info workloadInfoT
-		err  error
-	)
+// parseWorkload() parses and validates given WL spec JSON.  Returns
+// the spec, or rejection reason
+func parseWorkload(text []byte) (*wlspec.SpecT, string) {
+	var info wlspec.SpecT
 	log.Printf("workload: %s\n", string(text))
-	if err = json.Unmarshal(text, &info); err != nil {
-		log.Printf("WARN, ignoring WL, unmarshaling its info JSON failed: %v", err)
-		return false
+	problems := problemsT{unknownFatal: !allowUnknownFields}
+	ok := parseJSON("WL", text, &info, &problems)
+	for _, problem := range problems.list {
+		log.Print(problem)
 	}
-	if info.Name == "" {
-		log.Printf("WARN, ignoring WL with invalid name '', ")
-		return false
+	if !ok || problems.errorCount() > 0 {
+		log.Printf("WARN, ignoring WL, unmarshaling its info JSON failed")
+		return nil, rejectUnmarshal
+	}
+	if err := info.Validate(); err != nil {
+		log.Printf("WARN, ignoring %v", err)
+		return nil, rejectInvalid
 	}
-	if len(info.Profile) == 0 {
-		log.Printf("WARN, ignoring WL '%s' with no activity profile(s)", info.Name)
+	return &info, ""
+}
+
+// addWorkload() adds base load WL with given spec JSON to given devices
+func addWorkload(text []byte, devmap map[int]bool) bool {
+	info, reason := parseWorkload(text)
+	if reason == "" {
+		reason = startWorkload(info, devmap, nil)
+	}
+	if reason != "" {
+		stats.rejected[reason]++
 		return false
 	}
+	return true
+}
+
+// startWorkload() starts simulating given WL on its devices, or given ones
+// if WL spec does not specify any.  Returns rejection reason if WL could
+// not be started, e.g. rejectBusy when its devices have no free shares
+func startWorkload(info *wlspec.SpecT, devmap map[int]bool, client *clientT) string {
+	busy := false
 	if len(info.Devices) > 0 {
 		devmap = mapDevices(info.Devices)
+	} else if info.Selector != nil {
+		devmap, busy = mapSelector(info.Selector)
+	}
+	if busy {
+		log.Printf("WARN, not enough free devices for WL '%s' selector", info.Name)
+		return rejectBusy
 	}
 	if len(devmap) == 0 {
 		log.Printf("WARN, ignoring WL '%s' with no mapped devices", info.Name)
-		return false
+		return rejectDevices
+	}
+	if client != nil {
+		if reason := admit(info.Name, devmap); reason != "" {
+			return reason
+		}
 	}
 	if info.Limits != nil {
 		log.Printf("TODO, ignoring WL '%s' limits until metric dependencies work", info.Name)
@@ -90,17 +127,6 @@ func addWorkload(text []byte, devmap map[int]bool, conn net.Conn) bool {
 	total := time.Duration(0)
 	profile := make([]devProfileT, len(info.Profile))
 	for i, p := range info.Profile {
-		// validate simulation values
-		if p.Load < 0 || p.Load > 100 || p.Fluctuation < 0 || p.Fluctuation > 100 {
-			log.Printf("WARN, ignoring WL where activity %d per-device load %d or %d fluctuation is not within 0-100",
-				i, p.Load, p.Fluctuation)
-			return false
-		}
-		if (p.Load-p.Fluctuation) < 0 || (p.Load+p.Fluctuation) > 100 {
-			log.Printf("WARN, ignoring WL where activity %d per-device %d load +/- %d fluctuation is not within 0-100",
-				i, p.Load, p.Fluctuation)
-			return false
-		}
 		// time from given activity start
 		var seconds time.Duration
 		if p.Seconds > 0 {
@@ -118,15 +144,54 @@ func addWorkload(text []byte, devmap map[int]bool, conn net.Conn) bool {
 			seconds:     total,
 		}
 	}
+	activity, repeat := 0, info.Repeat
+	if info.Elapsed > 0 {
+		elapsed := time.Duration(info.Elapsed * float64(time.Second))
+		activity, repeat = resumeProfile(profile, repeat, elapsed, now)
+		log.Printf("Resuming workload '%s' at %gs, from activity %d/%d", info.Name, info.Elapsed, activity, len(profile))
+	}
 	workload = append(workload, workloadT{
-		name:    info.Name,
-		conn:    conn,
-		devmap:  devmap,
-		profile: profile,
-		repeat:  info.Repeat,
+		name:     info.Name,
+		metadata: info.Metadata,
+		client:   client,
+		devmap:   devmap,
+		profile:  profile,
+		activity: activity,
+		repeat:   repeat,
 	})
-	log.Printf("Loaded %gs workload '%s' to %d simulated devices", total.Seconds(), info.Name, len(devmap))
-	return true
+	stats.added++
+	if client != nil {
+		client.started()
+	}
+	log.Printf("Loaded %gs workload '%s' (%v) to %d simulated devices",
+		total.Seconds(), info.Name, info.Metadata, len(devmap))
+	return ""
+}
+
+// resumeProfile() shifts profile deadlines to match given time elapsed
+// since WL was originally started, and returns index of the activity
+// to resume, and how many repeats are then still remaining
+func resumeProfile(profile []devProfileT, repeat uint, elapsed time.Duration, now time.Time) (int, uint) {
+	total := profile[len(profile)-1].seconds
+	rounds := uint(elapsed / total)
+	offset := elapsed - time.Duration(rounds)*total
+	if repeat > 0 {
+		if rounds >= repeat {
+			// all done, let updateWorkloads() remove WL
+			rounds = repeat - 1
+			offset = total
+		}
+		repeat -= rounds
+	}
+	start := now.Add(-offset)
+	activity := len(profile) - 1
+	for i := range profile {
+		profile[i].deadline = start.Add(profile[i].seconds)
+		if offset < profile[i].seconds && i < activity {
+			activity = i
+		}
+	}
+	return activity, repeat
 }
 
 type filter func(int) bool
@@ -144,13 +209,16 @@ func loadWorkload(path string, devcount int, fn filter) {
 	if data, err = os.ReadFile(path); err != nil {
 		log.Fatalf("Unable to read WL info JSON file '%s': %v", path, err)
 	}
+	if data, err = yamljson.ToJSON(path, data); err != nil {
+		log.Fatalf("Unable to convert WL info YAML file '%s' to JSON: %v", path, err)
+	}
 	devmap := make(map[int]bool)
 	for i := 0; i < devcount; i++ {
 		if fn(i) {
 			devmap[i] = true
 		}
 	}
-	addWorkload(data, devmap, nil)
+	addWorkload(data, devmap)
 }
 
 // listenForWorkloads() listens on given socket and pushes accepted
@@ -162,18 +230,71 @@ func listenForWorkloads(path string) {
 		log.Fatalf("Unix socket '%s' listening failed: %v", path, err)
 	}
 	log.Printf("Listening on unix socket '%s'", path)
+	// backlog overflow is rejected by single go routine, so that
+	// connection floods do not pile up unbounded number of them
+	rejects := make(chan net.Conn, cap(connections))
+	go rejectConnections(rejects, rejectBacklogFull)
 	for {
 		conn, err := l.Accept()
 		if err == nil {
-			connections <- conn
+			select {
+			case connections <- conn:
+			default:
+				// don't stall accepts until next scrape
+				log.Printf("WL accept backlog (%d) full, rejecting WL connection", cap(connections))
+				backlogRejects.Add(1)
+				select {
+				case rejects <- conn:
+				default:
+					// rejecter is also behind, WL sees just disconnect
+					conn.Close()
+				}
+			}
 			continue
 		}
 		log.Printf("Unix socket '%s' accept fail: %v", path, err)
+		acceptErrors.Add(1)
 	}
 }
 
-// acceptWorkloads() reads and adds all queued incoming workloads
+// rejectConnections() rejects WL connections from given channel for given
+// reason without the simulation mutex, after reading their spec, so that
+// WLs see the reply.  Deadlines limit how long each connection can take
+func rejectConnections(conns chan net.Conn, reason string) {
+	for conn := range conns {
+		var text json.RawMessage
+		conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+		json.NewDecoder(io.LimitReader(conn, wlMaxSpec)).Decode(&text)
+		conn.Write([]byte(wlspec.ErrorReply(reason)))
+		conn.Close()
+	}
+}
+
+// readSpec() reads WL spec JSON from client connection, using JSON decoder
+// to find where it ends, as spec size is not known beforehand.  Returns spec
+// JSON, or rejection reason
+func (c *clientT) readSpec() (json.RawMessage, string) {
+	var text json.RawMessage
+	decoder := json.NewDecoder(io.LimitReader(c.conn, wlMaxSpec))
+	err := decoder.Decode(&text)
+	if err == nil {
+		// decoder may have buffered data past the spec
+		c.rest = io.MultiReader(decoder.Buffered(), c.conn)
+		return text, ""
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		log.Printf("WARN, ignoring WL, invalid spec JSON: %v", err)
+		return nil, rejectUnmarshal
+	}
+	log.Printf("WARN, ignoring WL, reading its spec (max %d bytes) failed: %v", wlMaxSpec, err)
+	return nil, rejectRead
+}
+
+// acceptWorkloads() starts queued WLs for which devices have been freed,
+// and reads and adds all new incoming workloads
 func acceptWorkloads() {
+	startQueued()
 	for {
 		var c net.Conn
 		select {
@@ -182,22 +303,84 @@ func acceptWorkloads() {
 		default:
 			return
 		}
-		data := make([]byte, 1024)
+		client := &clientT{conn: c}
 		c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
-		count, err := c.Read(data)
-		if count <= 0 || err != nil {
-			log.Printf("Zero bytes or error from WL connection read: %d, %v", count, err)
-		} else {
-			log.Printf("New WL connected, with %d bytes spec\n", count)
-			if addWorkload(data[:count], nil, c) {
-				continue
-			}
+		data, reason := client.readSpec()
+		if reason != "" {
+			rejectWorkload(client, reason)
+			continue
+		}
+		log.Printf("New WL connected, with %d bytes spec\n", len(data))
+		info, reason := parseWorkload(data)
+		if reason != "" {
+			rejectWorkload(client, reason)
+			continue
+		}
+		go client.watch(info.Name)
+		reason = startWorkload(info, nil, client)
+		if reason != "" && !queueWorkload(info, client, reason) {
+			rejectWorkload(client, reason)
 		}
-		c.Write([]byte(wlExitError))
-		c.Close()
 	}
 }
 
+// reply() sends given reply to client and closes its connection, unless
+// connection has already ended.  Given end reason is recorded for the
+// connection.  Returns false if connection had already ended
+func (c *clientT) reply(msg, end string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.end != "" {
+		return false
+	}
+	c.end = end
+	c.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	c.conn.Write([]byte(msg))
+	c.conn.Close()
+	return true
+}
+
+// started() tells client WL that its simulation started, so that WL knows
+// from when to count elapsed time, if it needs to be resumed
+func (c *clientT) started() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.end == "" {
+		c.conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		c.conn.Write([]byte(wlspec.StartedReply))
+	}
+}
+
+// watch() waits until WL with given name cancels, or its connection drops.
+// Cancel is acknowledged and connection closed.  Run as go routine, so that
+// WL does not need to wait for next metrics query (which would then notice
+// the connection end) to get the acknowledgement
+func (c *clientT) watch(name string) {
+	c.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(wlCancel))
+	_, err := io.ReadFull(c.rest, buf)
+	if err == nil && string(buf) == wlCancel {
+		if c.reply(wlExitCancelled, endCancelled) {
+			log.Printf("WL '%s' cancelled\n", name)
+		}
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.end == "" {
+		log.Printf("WL '%s' disconnected: %v\n", name, err)
+		c.end = endDisconnected
+		c.conn.Close()
+	}
+}
+
+// ended() returns why client connection ended, or empty string if it's active
+func (c *clientT) ended() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.end
+}
+
 // addWorkloadsToMetric() adds load + fluctuation from each workload being
 // simulated on given device, to the given metric value and returns the result
 func addWorkloadsToMetric(dev int, value float64, limit limitT) float64 {
@@ -222,20 +405,9 @@ func updateWorkloads() {
 	now := time.Now()
 	rm := make([]int, 0)
 	for i, wl := range workload {
-		if wl.conn != nil {
-			// TODO: this is really annoying, for disconnect detection
-			// to work, it must try non-zero sized read with deadline
-			// in *future* i.e. this adds delay to updates
-			//
-			// Unix module would allow checking connection state
-			// (extract its FD, use syscalls to check the state),
-			// but it's not in Golang standard library
-			buf := make([]byte, 1)
-			wl.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
-			_, err := wl.conn.Read(buf)
-			if !errors.Is(err, os.ErrDeadlineExceeded) {
-				log.Printf("WL-%d disconnected: %v\n", i, err)
-				workload[i].conn = nil
+		if wl.client != nil {
+			if reason := wl.client.ended(); reason != "" {
+				stats.ended[reason]++
 				rm = append(rm, i)
 				continue
 			}
@@ -258,6 +430,7 @@ func updateWorkloads() {
 		}
 		if wl.repeat == 1 {
 			// all done, mark WL for removal
+			stats.ended[endCompleted]++
 			rm = append(rm, i)
 			continue
 		}
@@ -288,11 +461,9 @@ func removeWorkloads(rm []int) {
 	count := len(workload)
 	for i, wli := range rm {
 		offset := count - i - 1
-		log.Printf("Removing WL-%d ('%s')", wli, workload[wli].name)
-		if workload[wli].conn != nil {
-			c := workload[wli].conn
-			c.Write([]byte(wlExitOK))
-			c.Close()
+		log.Printf("Removing WL-%d ('%s', %v)", wli, workload[wli].name, workload[wli].metadata)
+		if workload[wli].client != nil {
+			workload[wli].client.reply(wlExitOK, endCompleted)
 		}
 		workload[wli] = workload[offset]
 		// make sure moved WL gets GCed
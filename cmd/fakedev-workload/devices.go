@@ -0,0 +1,148 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// discoveryT specifies how WL devices are discovered,
+// and how they're mapped to server device names
+type discoveryT struct {
+	glob   string // device file glob pattern
+	env    string // environment variable listing device IDs
+	cdi    string // CDI spec file listing devices
+	regexp string // regexp for extracting device IDs
+	name   string // server device name template
+}
+
+// cdiSpecT contains the CDI spec parts relevant for device discovery, see:
+// https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+type cdiSpecT struct {
+	Kind    string
+	Devices []struct {
+		Name string
+	}
+}
+
+// getDevices() returns list of device file paths matching
+// the device glob pattern. If none are found, process terminates
+func getDevices(glob string) []string {
+	// available device file name paths
+	paths, err := filepath.Glob(glob)
+	if paths == nil || err != nil {
+		log.Fatalf("ERROR: no files matching glob pattern '%s'", glob)
+	}
+	return paths
+}
+
+// getEnvDevices() returns list of comma separated device IDs from
+// given environment variable.  If there are none, process terminates
+func getEnvDevices(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		log.Fatalf("ERROR: no device IDs in $%s", name)
+	}
+	return strings.Split(value, ",")
+}
+
+// getCDIDevices() returns names of devices in given CDI spec file.  If list of
+// allowed devices is given, only device names matching those (either as fully
+// qualified CDI device names, or just as names) are returned
+func getCDIDevices(file string, allowed []string) []string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("ERROR: reading CDI spec file '%s' failed: %v", file, err)
+	}
+	var spec cdiSpecT
+	if err = json.Unmarshal(data, &spec); err != nil {
+		log.Fatalf("ERROR: unmarshaling CDI spec file '%s' failed: %v", file, err)
+	}
+	devices := make([]string, 0)
+	for _, dev := range spec.Devices {
+		if allowed == nil {
+			devices = append(devices, dev.Name)
+			continue
+		}
+		qualified := spec.Kind + "=" + dev.Name
+		for _, name := range allowed {
+			if name == dev.Name || name == qualified {
+				devices = append(devices, dev.Name)
+				break
+			}
+		}
+	}
+	if len(devices) == 0 {
+		log.Fatalf("ERROR: no (allowed) devices in CDI spec file '%s'", file)
+	}
+	return devices
+}
+
+// extractIDs() returns device IDs extracted from given names with given
+// regexp, using its first sub-match if it has one.  Names not matching
+// regexp are skipped, and if none match, process terminates
+func extractIDs(names []string, expr string) []string {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		log.Fatalf("ERROR: invalid device regexp '%s': %v", expr, err)
+	}
+	ids := make([]string, 0)
+	for _, name := range names {
+		match := re.FindStringSubmatch(name)
+		if match == nil {
+			log.Printf("WARN: device '%s' does not match regexp '%s', skipping", name, expr)
+			continue
+		}
+		id := match[0]
+		if len(match) > 1 {
+			id = match[1]
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		log.Fatalf("ERROR: none of the devices %v match regexp '%s'", names, expr)
+	}
+	return ids
+}
+
+// discoverDevices() returns device names for the server, based on devices
+// discovered with given method.  Without regexp, base names of matched device
+// files are used as-is. Device IDs are mapped to names with name template,
+// if one is given
+func discoverDevices(d discoveryT) []string {
+	var ids []string
+	switch {
+	case d.cdi != "":
+		var allowed []string
+		if d.env != "" {
+			allowed = getEnvDevices(d.env)
+		}
+		ids = getCDIDevices(d.cdi, allowed)
+	case d.env != "":
+		ids = getEnvDevices(d.env)
+	default:
+		ids = getDevices(d.glob)
+		if d.regexp == "" {
+			for i, dev := range ids {
+				ids[i] = path.Base(dev)
+			}
+		}
+	}
+	if d.regexp != "" {
+		ids = extractIDs(ids, d.regexp)
+	}
+	if d.name == "" {
+		return ids
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = strings.ReplaceAll(d.name, "INDEX", id)
+	}
+	return names
+}
@@ -3,155 +3,356 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/intel/fakedev-exporter/version"
+	"github.com/intel/fakedev-exporter/wlspec"
+	"github.com/intel/fakedev-exporter/yamljson"
 )
 
-// wlProfileT values are in percents and seconds
-type profileT struct {
-	Load        uint
-	Fluctuation uint
-	Seconds     uint
-}
+const (
+	// message telling server that WL was terminated before its end
+	msgCancel = "cancel"
+	// exit code when WL was terminated by a signal
+	exitCancelled = 2
+	// limits for delay between server reconnect attempts
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
 
-type workloadT struct {
-	Name    string
-	Repeat  uint
-	Profile []profileT
-	Devices []string
-	Limits  map[string]float64
+type optionsT struct {
+	socket    string
+	timeout   time.Duration // for WL cancel acknowledgement
+	reconnect time.Duration // for server reconnect attempts, 0 = disabled
 }
 
-// getDevices() returns list of device (base) file names matching
-// the device glob pattern. If none are found, process terminates
-func getDevices(glob string) []string {
-	// available device file name paths
-	paths, err := filepath.Glob(glob)
-	if paths == nil || err != nil {
-		log.Fatalf("ERROR: no files matching glob pattern '%s'", glob)
-	}
-	devices := make([]string, len(paths))
-	for i, dev := range paths {
-		devices[i] = path.Base(dev)
-	}
-	return devices
+// replyT is server reply to WL, or error from reading it
+type replyT struct {
+	code string
+	err  error
+	// when server told WL simulation started, zero if it did not
+	started time.Time
 }
 
 // getDevnames() replaces "INDEX" with $JOB_COMPLETION_INDEX % max value in given string,
 // if max is set. Returns results split at commas
 func getDevnames(names string, max int) []string {
 	if max > 0 {
-		// https://kubernetes.io/docs/tasks/job/indexed-parallel-processing-static/
-		jobi := os.Getenv("JOB_COMPLETION_INDEX")
-		if jobi == "" {
-			log.Fatalf("ERROR: max-index option used, but $JOB_COMPLETION_INDEX not set")
-		}
-		if index, err := strconv.Atoi(jobi); err != nil {
-			log.Fatalf("ERROR: parsing $JOB_COMPLETION_INDEX value ('%s') failed: %v", jobi, err)
-		} else {
-			names = strings.ReplaceAll(names, "INDEX", strconv.Itoa(index%max))
+		index, err := jobIndex()
+		if err != nil {
+			log.Fatalf("ERROR: max-index option used, but %v", err)
 		}
+		names = strings.ReplaceAll(names, "INDEX", strconv.Itoa(index%max))
 	}
 	return strings.Split(names, ",")
 }
 
+// parseLabels() parses "key=value" label lines, as used by the downward API
+// labels file (where values are quoted), appending them to the given map
+func parseLabels(labels map[string]string, lines []string) error {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found || key == "" {
+			return fmt.Errorf("invalid label '%s', not in 'key=value' format", line)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		labels[key] = value
+	}
+	return nil
+}
+
+// getMetadata() returns pod metadata from downward API environment variables,
+// and from downward API volume files in the given directory, if one is given.
+// Latter override former
+func getMetadata(dir string) wlspec.MetadataT {
+	md := wlspec.MetadataT{
+		Pod:       os.Getenv("POD_NAME"),
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Node:      os.Getenv("NODE_NAME"),
+		Container: os.Getenv("CONTAINER_NAME"),
+		Labels:    make(map[string]string),
+	}
+	if err := parseLabels(md.Labels, strings.Split(os.Getenv("POD_LABELS"), ",")); err != nil {
+		log.Fatalf("ERROR: parsing $POD_LABELS failed: %v", err)
+	}
+	if dir != "" {
+		files := map[string]*string{
+			"name":      &md.Pod,
+			"namespace": &md.Namespace,
+			"labels":    nil,
+		}
+		for name, value := range files {
+			path := filepath.Join(dir, name)
+			data, err := os.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				log.Fatalf("ERROR: reading downward API file '%s' failed: %v", path, err)
+			}
+			if value != nil {
+				*value = strings.TrimSpace(string(data))
+			} else if err = parseLabels(md.Labels, strings.Split(string(data), "\n")); err != nil {
+				log.Fatalf("ERROR: parsing downward API file '%s' failed: %v", path, err)
+			}
+		}
+	}
+	if len(md.Labels) == 0 {
+		md.Labels = nil
+	}
+	return md
+}
+
 // parseProfiles() parses given activity profile list spec, if one is given,
 // and overrides the WL list with it.  Terminates if list is empty.
-func parseProfiles(spec string) []profileT {
+func parseProfiles(spec string) []wlspec.ProfileT {
 	if spec == "" {
-		return []profileT{}
+		return []wlspec.ProfileT{}
 	}
-	profile := make([]profileT, 0)
+	profile := make([]wlspec.ProfileT, 0)
 	for _, act := range strings.Split(spec, ",") {
-		var load, flux, secs uint
+		var load, flux int
+		var secs uint
 		n, err := fmt.Sscanf(act, "%v:%v:%v", &load, &flux, &secs)
 		if err != nil || n != 3 {
 			log.Fatalf("ERROR: profile '%s' - %d integers, not 3: %v", act, n, err)
 		}
-		if load > 100 || flux > load {
-			log.Fatalf("ERROR: invalid load (%d > 100) or fluctuation (%d > load) values in '%s'", load, flux, act)
-		}
-		profile = append(profile, profileT{load, flux, secs})
+		profile = append(profile, wlspec.ProfileT{Load: load, Fluctuation: flux, Seconds: secs})
 	}
 	return profile
 }
 
-func parseJSON(name string, wl *workloadT) {
+// parseJSON() expands templates in given JSON (or YAML) WL spec file,
+// and overrides WL values with the ones from the result.  Unknown
+// fields in the file are an error, unless they are allowed
+func parseJSON(name string, wl *wlspec.SpecT, allowUnknown bool) {
 	if name == "" {
 		return
 	}
-	if data, err := os.ReadFile(name); err == nil {
-		if err = json.Unmarshal(data, &wl); err != nil {
-			log.Fatalf("ERROR: Unmarshaling JSON spec file '%s' failed", name)
-		}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		log.Fatalf("ERROR: reading JSON spec file '%s' failed: %v", name, err)
+	}
+	if data, err = expandTemplate(name, data); err != nil {
+		log.Fatalf("ERROR: expanding templates in JSON spec file '%s' failed: %v", name, err)
+	}
+	if data, err = yamljson.ToJSON(name, data); err != nil {
+		log.Fatalf("ERROR: converting YAML spec file '%s' to JSON failed: %v", name, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if !allowUnknown {
+		decoder.DisallowUnknownFields()
+	}
+	if err = decoder.Decode(wl); err != nil {
+		log.Fatalf("ERROR: Unmarshaling JSON spec file '%s' failed: %v", name, err)
 	}
 }
 
-func parseArgs() (workloadT, string) {
-	wl := workloadT{}
-	var activity, devices, devnames, json, socket string
-	flag.StringVar(&wl.Name, "name", "Workload", "Workload / pod name")
+func parseArgs() (wlspec.SpecT, optionsT) {
+	wl := wlspec.SpecT{}
+	opts := optionsT{}
+	var activity, devnames, json, podinfo string
+	var disco discoveryT
+	var showVersion, allowUnknown bool
+	flag.StringVar(&wl.Name, "name", "", "Workload name, defaults to $POD_NAME, or 'Workload' if that is not set")
 	flag.UintVar(&wl.Repeat, "repeat", 1, "How many times activity is simulated, 0 = forever")
 	flag.StringVar(&activity, "activity", "98:1:0", "Comma separated list of '<load>:<fluctuation>:<seconds>' device utilization percentage and duration")
-	flag.StringVar(&devices, "devices", "/dev/dri/card*", "Glob pattern for matching device file(s) (mapped to WL container) on which activity is to be simulated")
+	flag.StringVar(&disco.glob, "devices", "/dev/dri/card*", "Glob pattern for matching device file(s) (mapped to WL container) on which activity is to be simulated")
+	flag.StringVar(&disco.env, "device-env", "", "Instead of device file glob, get comma separated device IDs from given environment variable")
+	flag.StringVar(&disco.cdi, "cdi-spec", "", "Instead of device file glob, get device IDs from given CDI spec JSON file (limited to ones listed in -device-env variable, if that is also given)")
+	flag.StringVar(&disco.regexp, "device-regexp", "", "Regexp for extracting device ID from glob matched device file paths (or other device IDs). First sub-match is used, if regexp has one")
+	flag.StringVar(&disco.name, "device-name", "", "Server device name template, where 'INDEX' is replaced with discovered device ID")
 	flag.StringVar(&devnames, "devnames", "", "Instead of matching devices assigned by device plugin, simulate activity on given comma separate list of device(s)")
-	flag.StringVar(&socket, "socket", "/tmp/fakedev-exporter", "Unix socket for workload communication")
-	flag.StringVar(&json, "json", "", "JSON workload spec file, alternative way of providing name, repeat and activity information")
+	flag.StringVar(&opts.socket, "socket", "/tmp/fakedev-exporter", "Unix socket for workload communication")
+	flag.StringVar(&json, "json", "", "JSON (or YAML) workload spec file, alternative way of providing name, repeat and activity information")
+	flag.DurationVar(&opts.timeout, "cancel-timeout", 2*time.Second, "How long to wait for server to acknowledge WL cancellation on SIGTERM / SIGINT")
+	flag.StringVar(&podinfo, "podinfo", "", "Directory with k8s downward API volume 'name', 'namespace' and 'labels' files")
+	flag.DurationVar(&opts.reconnect, "reconnect", 0, "If non-zero, how long to retry (with backoff) connecting to (restarted) server, before failing. WL is then resumed from where it was")
+	var selector wlspec.SelectorT
+	flag.Func("select", "Instead of device names, select devices by their labels on server side, with Prometheus style label matcher, e.g. 'pciid=0x4905' or 'addr=~\"0000:0a:.*\"'. Can be given multiple times", func(text string) error {
+		_, err := wlspec.ParseMatcher(text)
+		selector.Labels = append(selector.Labels, text)
+		return err
+	})
+	flag.UintVar(&selector.Count, "select-count", 0, "If non-zero, how many (free) devices matching -select matchers (or any free devices, if none) WL needs")
 	var max int
 	flag.IntVar(&max, "max-index", 0, "If given, 'INDEX' in devname is replaced with value of JOB_COMPLETION_INDEX % <max-index>")
+	flag.BoolVar(&allowUnknown, "allow-unknown-fields", false, "Ignore unknown fields in JSON workload spec file, instead of failing")
+	flag.BoolVar(&showVersion, "version", false, "Show version and build information, and exit")
 	flag.Parse()
-
-	if devnames == "" {
-		wl.Devices = getDevices(devices)
-	} else {
-		wl.Devices = getDevnames(devnames, max)
+	if showVersion {
+		fmt.Println(version.BuildInfo("fakedev-workload"))
+		os.Exit(0)
 	}
+	log.Print(version.Info("fakedev-workload"))
+
 	wl.Profile = parseProfiles(activity)
-	if len(wl.Profile) == 0 {
-		log.Fatal("ERROR: no WL activity specified")
+	wl.Metadata = getMetadata(podinfo)
+	if wl.Name == "" {
+		wl.Name = wl.Metadata.Pod
 	}
-	parseJSON(json, &wl)
 	if wl.Name == "" {
-		log.Fatal("ERROR: Workload name is missing")
+		wl.Name = "Workload"
 	}
-	return wl, socket
+	if len(selector.Labels) > 0 || selector.Count > 0 {
+		wl.Selector = &selector
+	}
+	parseJSON(json, &wl, allowUnknown)
+	// devices are selected on server side, or given in JSON spec
+	if wl.Selector == nil && len(wl.Devices) == 0 {
+		if devnames == "" {
+			wl.Devices = discoverDevices(disco)
+		} else {
+			wl.Devices = getDevnames(devnames, max)
+		}
+	}
+	// same checks as on server side
+	if err := wl.Validate(); err != nil {
+		log.Fatalf("ERROR: invalid WL spec: %v", err)
+	}
+	return wl, opts
 }
 
-func main() {
-	wl, socket := parseArgs()
-	msg, err := json.MarshalIndent(wl, "", "\t")
-	if err != nil {
-		log.Fatalf("ERROR: internal WL marshaling error %v", err)
+// connect() connects to the server socket. If reconnect time is set, failed
+// connects are retried with exponential backoff until that time has passed.
+// Terminates on failure, or when signaled while waiting for a retry
+func connect(sig chan os.Signal, socket string, reconnect time.Duration) net.Conn {
+	deadline := time.Now().Add(reconnect)
+	backoff := minBackoff
+	for {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			return conn
+		}
+		if reconnect == 0 || time.Now().Add(backoff).After(deadline) {
+			log.Fatalf("ERROR: connection to 'fakedev-exporter' unix socket '%s' failed: %v", socket, err)
+		}
+		log.Printf("WARN: connection to 'fakedev-exporter' unix socket '%s' failed, retrying in %v: %v", socket, backoff, err)
+		select {
+		case s := <-sig:
+			log.Printf("Got signal %d while not connected => exiting", s)
+			os.Exit(exitCancelled)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
 	}
-	log.Printf("Workload: %v", string(msg))
+}
 
-	conn, err := net.Dial("unix", socket)
-	if err != nil {
-		log.Fatalf("ERROR: connection to 'fakedev-exporter' unix socket '%s' failed: %v", socket, err)
+// readReply() waits for server reply, and passes it to the given channel,
+// along with time when server told that WL simulation started
+func readReply(conn net.Conn, replies chan replyT) {
+	var started time.Time
+	reader := bufio.NewReader(conn)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			replies <- replyT{"", err, started}
+			return
+		}
+		if string(b) != wlspec.StartedReply {
+			reader.UnreadByte()
+			break
+		}
+		started = time.Now()
+		log.Print("Server started WL simulation")
 	}
-	defer conn.Close()
-	n, err := conn.Write(msg)
-	if err != nil || n != len(msg) {
-		log.Fatalf("ERROR: WL spec write (%d/%d bytes) to 'fakedev-exporter' failed: %v", n, len(msg), err)
+	// server closes connection after exit code reply
+	data, err := io.ReadAll(reader)
+	replies <- replyT{string(data), err, started}
+}
+
+// cancel() tells server that WL was cancelled, and waits given time for
+// server to acknowledge that. Terminates if acknowledgement is not received
+func cancel(conn net.Conn, replies chan replyT, timeout time.Duration) replyT {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Write([]byte(msgCancel))
+	if err != nil || n != len(msgCancel) {
+		log.Printf("ERROR: WL cancel write (%d/%d bytes) to 'fakedev-exporter' failed: %v", n, len(msgCancel), err)
+		os.Exit(exitCancelled)
 	}
-	// wait until server tells to exit with given exit code
-	data := make([]byte, 8)
-	n, err = conn.Read(data)
-	if err != nil {
-		log.Fatalf("ERROR: 'fakedev-exporter' socket read failed: %v", err)
+	reply := <-replies
+	if reply.err != nil {
+		log.Printf("WARN: no WL cancel acknowledgement from 'fakedev-exporter' within %v: %v", timeout, reply.err)
+		os.Exit(exitCancelled)
 	}
-	retval := string(data[:n])
-	ret, err := strconv.Atoi(retval)
+	return reply
+}
+
+func main() {
+	wl, opts := parseArgs()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	// when server first started WL simulation, not when WL connected
+	// (which may then have waited in a backlog or queue)
+	var start time.Time
+	var reply replyT
+	for {
+		conn := connect(sig, opts.socket, opts.reconnect)
+		if !start.IsZero() {
+			// resume WL from where it was
+			wl.Elapsed = time.Since(start).Seconds()
+		}
+		msg, err := json.Marshal(wl)
+		if err != nil {
+			log.Fatalf("ERROR: internal WL marshaling error %v", err)
+		}
+		log.Printf("Workload: %v", string(msg))
+		n, err := conn.Write(msg)
+		if err != nil || n != len(msg) {
+			log.Fatalf("ERROR: WL spec write (%d/%d bytes) to 'fakedev-exporter' failed: %v", n, len(msg), err)
+		}
+		// wait until server tells to exit with given exit code
+		replies := make(chan replyT, 1)
+		go readReply(conn, replies)
+		select {
+		case s := <-sig:
+			log.Printf("Got signal %d => cancelling WL", s)
+			reply = cancel(conn, replies, opts.timeout)
+		case reply = <-replies:
+		}
+		conn.Close()
+		if start.IsZero() {
+			start = reply.started
+		}
+		if reply.err == nil {
+			break
+		}
+		if opts.reconnect == 0 {
+			log.Fatalf("ERROR: 'fakedev-exporter' socket read failed: %v", reply.err)
+		}
+		if start.IsZero() {
+			log.Printf("WARN: 'fakedev-exporter' socket read failed before WL was started, reconnecting: %v", reply.err)
+		} else {
+			log.Printf("WARN: 'fakedev-exporter' socket read failed %v after WL start, reconnecting: %v", time.Since(start), reply.err)
+		}
+	}
+	ret, reason, err := wlspec.ParseReply(reply.code)
 	if err != nil {
-		log.Fatalf("ERROR: could not parse 'fakedev-exporter' exit code '%s': %v", retval, err)
+		log.Fatalf("ERROR: could not parse 'fakedev-exporter' exit code '%s': %v", reply.code, err)
+	}
+	if reason != "" {
+		log.Printf("WL rejected by server, reason: %s", reason)
 	}
 	log.Printf("Exiting with code %d returned by server", ret)
 	os.Exit(ret)
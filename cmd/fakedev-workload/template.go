@@ -0,0 +1,69 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+// templateDataT provides values for the WL spec templates
+type templateDataT struct{}
+
+// jobIndex() returns value of the k8s indexed Job completion index, see:
+// https://kubernetes.io/docs/tasks/job/indexed-parallel-processing-static/
+func jobIndex() (int, error) {
+	jobi := os.Getenv("JOB_COMPLETION_INDEX")
+	if jobi == "" {
+		return 0, fmt.Errorf("$JOB_COMPLETION_INDEX not set")
+	}
+	index, err := strconv.Atoi(jobi)
+	if err != nil {
+		return 0, fmt.Errorf("parsing $JOB_COMPLETION_INDEX value ('%s') failed: %v", jobi, err)
+	}
+	return index, nil
+}
+
+// Index returns $JOB_COMPLETION_INDEX value for the templates
+func (templateDataT) Index() (int, error) {
+	return jobIndex()
+}
+
+// templateFuncs are (integer) helpers for calculating WL spec values, e.g:
+//
+//	"Load": {{add 10 (mul 5 .Index)}}
+//	"Seconds": {{index (list 30 60 90) (mod .Index 3)}}
+var templateFuncs = template.FuncMap{
+	"add": func(a, b int) int { return a + b },
+	"sub": func(a, b int) int { return a - b },
+	"mul": func(a, b int) int { return a * b },
+	"div": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	},
+	"mod": func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("modulo by zero")
+		}
+		return a % b, nil
+	},
+	"list": func(items ...any) []any { return items },
+}
+
+// expandTemplate() expands Go text/template actions in given WL spec text
+func expandTemplate(name string, text []byte) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, templateDataT{}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
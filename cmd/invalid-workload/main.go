@@ -12,9 +12,12 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
 	"time"
+
+	"github.com/intel/fakedev-exporter/version"
+	"github.com/intel/fakedev-exporter/wlspec"
 )
 
 const readTimeoutMs = 200
@@ -58,29 +61,35 @@ func sendInvalidMsg(path, url string, msg []byte) {
 	// provoke server to process new WL
 	queryMetrics(url)
 	// wait for server to provide error code
-	data := make([]byte, 8)
+	data := make([]byte, 64)
 	conn.SetReadDeadline(time.Now().Add(readTimeoutMs * time.Millisecond))
 	n, err = conn.Read(data)
 	if err != nil {
 		log.Fatalf("ERROR: 'fakedev-exporter' socket %dms read failed: %v", readTimeoutMs, err)
 	}
 	retval := string(data[:n])
-	ret, err := strconv.Atoi(retval)
+	ret, reason, err := wlspec.ParseReply(retval)
 	if err != nil {
 		log.Fatalf("ERROR: could not parse 'fakedev-exporter' exit code '%s': %v", retval, err)
 	}
 	if ret == 0 {
 		log.Fatal("ERROR: server returned zero, not an error code")
 	}
-	log.Printf("Server returned: %d", ret)
+	log.Printf("Server returned: %d (%s)", ret, reason)
 }
 
 func main() {
 	var devs, socket, url string
+	var showVersion bool
 	flag.StringVar(&devs, "devnames", "card0", "Comma separate list of device file names to use in communication")
 	flag.StringVar(&socket, "socket", "/tmp/fakedev-exporter", "Unix socket path for workload communication")
 	flag.StringVar(&url, "url", "http://127.0.0.1:9999/metrics", "URL where to query resulting metrics")
+	flag.BoolVar(&showVersion, "version", false, "Show version and build information, and exit")
 	flag.Parse()
+	if showVersion {
+		fmt.Println(version.BuildInfo("invalid-workload"))
+		os.Exit(0)
+	}
 	devnames := "[\"" + strings.Join(strings.Split(devs, ","), "\",\"") + "\"]"
 	log.Printf("Connecting to '%s' socket, prodding '%s' URL, and claiming to have device(s): %v", socket, url, devnames)
 	valid := []byte(fmt.Sprintf("{\"Name\":\"Invalid\",\"Devices\":%v,\"Profile\":[{\"Load\":0}],", devnames))
@@ -97,6 +106,8 @@ func main() {
 		append(valid, []byte("\"Profile\":[{\"Load\":-1}]}")...),
 		// invalid load+fluctuation total value
 		append(valid, []byte("\"Profile\":[{\"Load\":50,\"Fluctuation\":75}]}")...),
+		// unknown (misspelled) member
+		append(valid, []byte("\"Profile\":[{\"Load\":10,\"Fluctation\":5}]}")...),
 		// invalid large JSON string after valid content
 		append([]byte("{\"Name\":\")"), make([]byte, 64*1024)...),
 	}
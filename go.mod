@@ -1,3 +1,21 @@
-module fakedev-exporter
+module github.com/intel/fakedev-exporter
 
-go 1.22
+go 1.22.0
+
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/prometheus/client_model v0.6.1
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.34.2
+	k8s.io/kubelet v0.30.14
+	sigs.k8s.io/yaml v1.4.0
+)
+
+require (
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.4 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+)
@@ -10,17 +10,39 @@ set -e
 LINE="-----------------------------"
 TEST_ADDR="127.0.0.1:9999"
 TEST_URL="http://$TEST_ADDR/metrics"
+SELF_PATH="/self"
+FAULT_PATH="/faults"
+PLUGIN_DIR="$PWD/device-plugins"
+POD_SOCKET="$PLUGIN_DIR/pod-resources.sock"
+POD_PATH="/pods"
+SYSFS_ROOT="$PWD/fake-root"
+BAD_IDENTITY="$PWD/bad-identity.json"
+BAD_SCENARIO="$PWD/bad-scenario.yaml"
+BAD_DEVTYPE="$PWD/bad-devtype.json"
+UNKNOWN_WL="$PWD/unknown-field.json"
 SOCKET="/tmp/fakedev-exporter.socket"
+# for another exporter instance, with different options
+TEST2_ADDR="127.0.0.1:9998"
+TEST2_URL="http://$TEST2_ADDR/metrics"
+SOCKET2="/tmp/fakedev-exporter2.socket"
 DEVICES="card0,card1"
 pid=0
+pid2=0
+kpid=0
 
 error_exit () {
 	if [ $pid -gt 0 ]; then
 		kill $pid
 	fi
+	if [ $pid2 -gt 0 ]; then
+		kill $pid2
+	fi
+	if [ $kpid -gt 0 ]; then
+		kill $kpid
+	fi
 	echo "Test script for 'fakedev-exporter'."
 	echo
-	echo "Usage: ${0##*/} [fakedev-exporter [fakedev-workload [invalid-workload]]]"
+	echo "Usage: ${0##*/} [fakedev-exporter [fakedev-workload [invalid-workload [fake-kubelet]]]]"
 	echo
 	echo "Paths to given fakedev-* binaries need to be absolute."
 	echo
@@ -54,6 +76,11 @@ if [ $# -gt 0 ]; then
 	INVALID="$1"
 	shift
 fi
+KUBELET="$PWD/fake-kubelet"
+if [ $# -gt 0 ]; then
+	KUBELET="$1"
+	shift
+fi
 if [ ! -x "$FAKEDEV" ]; then
 	error_exit "'$FAKEDEV' (fakedev-exporter) missing, or not executable"
 fi
@@ -63,20 +90,153 @@ fi
 if [ ! -x "$INVALID" ]; then
 	error_exit "'$INVALID' (invalid-workload) missing, or not executable"
 fi
+if [ ! -x "$KUBELET" ]; then
+	error_exit "'$KUBELET' (fake-kubelet) missing, or not executable"
+fi
+
+echo "Run ${KUBELET##*/} (on background)..."
+"$KUBELET" -dir "$PLUGIN_DIR" -podresources "$POD_SOCKET" -allocate 1 -updates 2 &
+kpid=$!
 
 if ! cd "${0%/*}/configs"; then
 	error_exit "fakedev-exporter 'configs' dir missing"
 fi
+CONFIGS="$PWD"
+
+echo "Validate ${FAKEDEV##*/} configs..."
+if ! "$FAKEDEV" validate \
+	--count 2 \
+	--devlist devices/devlist.json \
+	--devtype devices/dg1-4905.json \
+	--identity identity/xpu-manager.json \
+	workloads/*.json workloads/*.yaml; then
+	error_exit "config validation failed"
+fi
+# more devices than fit to single PCI domain with devlist bus step
+if ! "$FAKEDEV" validate \
+	--count 300 \
+	--devlist devices/devlist.json \
+	--devtype devices/dg1-4905.json \
+	--identity identity/xpu-manager.json; then
+	error_exit "config validation for large device count failed"
+fi
+if ! "$FAKEDEV" validate --scenario scenarios/mixed-gpus.yaml; then
+	error_exit "scenario validation failed"
+fi
+# identity with same output names from different members
+cat > "$BAD_IDENTITY" << EOF
+{
+	"DeviceLabelMap": { "file": "device", "addr": "device" },
+	"MetricMap": { "power": "gpu_power", "temperature": "gpu_power" },
+	"MetricLabels": { "power": { "pod": "none" } },
+	"PodLabels": { "pod": "pod" },
+	"LabelSeparator": "; "
+}
+EOF
+if "$FAKEDEV" validate \
+	--count 2 \
+	--devlist devices/devlist.json \
+	--devtype devices/dg1-4905.json \
+	--identity "$BAD_IDENTITY" > bad-identity.txt; then
+	error_exit "identity with duplicate output names passed validation"
+fi
+cat bad-identity.txt
+if [ "$(grep -c duplicates bad-identity.txt)" -ne 3 ]; then
+	error_exit "not all identity duplicate output names were reported"
+fi
+if ! grep -q "LabelSeparator: ERROR" bad-identity.txt; then
+	error_exit "invalid identity label separator was not reported"
+fi
+rm "$BAD_IDENTITY" bad-identity.txt
+# base WL with both placement and spec device selector
+{
+	cat scenarios/mixed-gpus.yaml
+	cat << EOF
+- Select: {Indices: "0"}
+  Spec:
+    Name: base-both
+    Selector: {Labels: ['pciid="0x4905"']}
+    Profile:
+    - {Load: 10}
+EOF
+} > "$BAD_SCENARIO"
+if "$FAKEDEV" validate --scenario "$BAD_SCENARIO" > bad-scenario.txt; then
+	error_exit "base WL with both Select and Spec.Selector passed validation"
+fi
+cat bad-scenario.txt
+if ! grep -q "Workloads\[2\].Select: ERROR: both Select" bad-scenario.txt; then
+	error_exit "base WL with both Select and Spec.Selector was not reported"
+fi
+rm "$BAD_SCENARIO" bad-scenario.txt
+# WL with unknown field, which is just warned about when it's allowed
+echo '{"Name": "unknown", "Profile": [{"Load": 10}], "Lode": 20}' > "$UNKNOWN_WL"
+if "$FAKEDEV" validate "$UNKNOWN_WL" > unknown-field.txt; then
+	error_exit "WL with unknown field passed validation"
+fi
+if ! grep -q "Lode: ERROR: unknown field" unknown-field.txt; then
+	error_exit "WL unknown field was not reported as error"
+fi
+"$FAKEDEV" validate --allow-unknown-fields "$UNKNOWN_WL" > unknown-field.txt || true
+cat unknown-field.txt
+if ! grep -q "Lode: WARN" unknown-field.txt; then
+	error_exit "allowed WL unknown field was not reported as warning"
+fi
+rm "$UNKNOWN_WL" unknown-field.txt
+
+echo "Create fake sysfs tree with ${FAKEDEV##*/}..."
+if ! "$FAKEDEV" sysfs \
+	--count 2 \
+	--devlist devices/devlist.json \
+	--devtype devices/dg1-4905.json \
+	--sysfs-root "$SYSFS_ROOT"; then
+	error_exit "fake sysfs tree creation failed"
+fi
+if [ "$(cat "$SYSFS_ROOT/sys/class/drm/card1/device/device")" != "0x4905" ] ||
+	[ ! -f "$SYSFS_ROOT/dev/dri/by-path/pci-0000:03:01.0-render" ]; then
+	error_exit "fake sysfs tree lacks expected device entries"
+fi
+rm -r "$SYSFS_ROOT"
+if ! "$FAKEDEV" sysfs \
+	--count 2 \
+	--devlist devices/devlist-nvidia.json \
+	--devtype devices/a100-sxm4-40gb.json \
+	--sysfs-root "$SYSFS_ROOT"; then
+	error_exit "fake NVIDIA sysfs tree creation failed"
+fi
+if [ "$(cat "$SYSFS_ROOT/sys/class/drm/nvidia1/device/vendor")" != "0x10de" ]; then
+	error_exit "fake NVIDIA sysfs tree device has wrong vendor"
+fi
+rm -r "$SYSFS_ROOT"
+# device type without PCI ID
+echo '{"DeviceLabels": {"name": "nameless"}}' > "$BAD_DEVTYPE"
+if "$FAKEDEV" sysfs \
+	--count 2 \
+	--devlist devices/devlist.json \
+	--devtype "$BAD_DEVTYPE" \
+	--sysfs-root "$SYSFS_ROOT"; then
+	error_exit "fake sysfs tree created for devices without PCI ID"
+fi
+if [ -e "$SYSFS_ROOT" ]; then
+	error_exit "fake sysfs tree was partially created for invalid devices"
+fi
+rm "$BAD_DEVTYPE"
 
 echo "Run ${FAKEDEV##*/} (on background)..."
 "$FAKEDEV" \
 	--count 2 \
 	--socket $SOCKET \
 	--address $TEST_ADDR \
+	--self-path $SELF_PATH \
 	--devlist devices/devlist.json \
 	--devtype devices/dg1-4905.json \
-	--identity identity/xpu-manager.json \
+	--identity identity/xpu-manager.json,identity/dcgm.json=$POD_PATH \
 	--wl-all workloads/load-10-exact.json \
+	--fault-path $FAULT_PATH \
+	--plugin-resource fakedev.intel.com/gpu \
+	--plugin-dir "$PLUGIN_DIR" \
+	--plugin-devdir "$PLUGIN_DIR/dev" \
+	--podresources-socket "$POD_SOCKET" \
+	--podresources-interval 1s \
 	& # no args
 pid=$!
 sleep 1
@@ -132,9 +292,270 @@ check_fetch () {
 
 echo "$LINE"
 echo "*** Test normal (GET) query method working ***"
-if ! check_fetch "$TEST_URL"; then
+if ! check_fetch "$TEST_URL" > metrics.txt; then
 	error_exit "metric fetch failed"
 fi
+cat metrics.txt
+if grep -q fakedev_exporter_ metrics.txt; then
+	error_exit "self-metrics output along with device metrics"
+fi
+rm metrics.txt
+
+echo "$LINE"
+echo "*** Test protobuf exposition format negotiation ***"
+PROTO="application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+# fetch_type <Accept> <URL>: fetches given URL with given header
+# to metrics.out, and outputs response Content-Type value
+fetch_type () {
+	if ! wget -S -O metrics.out -q --header "Accept: $1" "$2" 2> headers.txt; then
+		error_exit "metric fetch with '$1' content type failed"
+	fi
+	sed -n 's/^ *Content-Type: //p' headers.txt
+}
+for url in "$TEST_URL" "http://$TEST_ADDR$SELF_PATH"; do
+	case "$(fetch_type "$PROTO;q=0.7,text/plain;version=0.0.4;q=0.3" "$url")" in
+	application/vnd.google.protobuf*) ;;
+	*) error_exit "$url metrics were not in preferred protobuf format" ;;
+	esac
+	# protobuf includes metric names as-is
+	if grep -qa "^# " metrics.out || ! grep -qa "xpum_frequency_mhz\|fakedev_exporter_scrapes_total" metrics.out; then
+		error_exit "$url protobuf metrics are invalid"
+	fi
+done
+case "$(fetch_type "$PROTO;q=0.3,text/plain;version=0.0.4;q=0.7" "$TEST_URL")" in
+text/plain*) ;;
+*) error_exit "metrics were not in preferred text format" ;;
+esac
+rm metrics.out headers.txt
+
+echo "$LINE"
+echo "*** Test response compression negotiation ***"
+# fetch_encoded <Accept-Encoding>: fetches metrics with given header
+# to metrics.out, and outputs response Content-Encoding value
+fetch_encoded () {
+	if ! wget -S -O metrics.out -q --header "Accept-Encoding: $1" "$TEST_URL" 2> headers.txt; then
+		error_exit "metric fetch with '$1' encoding failed"
+	fi
+	if ! grep -q "Vary: Accept-Encoding" headers.txt; then
+		error_exit "response lacks Vary header"
+	fi
+	sed -n 's/^ *Content-Encoding: //p' headers.txt
+}
+if [ "$(fetch_encoded "zstd;q=0, gzip")" != "gzip" ]; then
+	error_exit "metrics were not gzip compressed"
+fi
+if ! gunzip < metrics.out | grep -q "^xpum_"; then
+	error_exit "gzip compressed metrics are invalid"
+fi
+if [ -n "$(fetch_encoded "identity")" ] || ! grep -q "^xpum_" metrics.out; then
+	error_exit "metrics were compressed, although client did not accept that"
+fi
+rm metrics.out headers.txt
+
+echo "$LINE"
+echo "*** Test zstd compressed responses (with reused encoders) ***"
+for i in 1 2 3; do
+	if ! wget -S -O metrics.zst -q --header "Accept-Encoding: zstd" "$TEST_URL" 2> headers.txt; then
+		error_exit "zstd compressed metric fetch failed"
+	fi
+	cat headers.txt
+	if ! grep -q "Content-Encoding: zstd" headers.txt; then
+		error_exit "metrics were not zstd compressed"
+	fi
+	# zstd frame magic number
+	if [ "$(od -A n -t x1 -N 4 metrics.zst | tr -d ' ')" != "28b52ffd" ]; then
+		error_exit "metrics response is not zstd data"
+	fi
+done
+rm metrics.zst headers.txt
+
+echo "$LINE"
+echo "*** Test DCGM identity output quirks ***"
+if ! check_fetch "http://$TEST_ADDR$POD_PATH" > dcgm.txt; then
+	error_exit "DCGM identity metric fetch failed"
+fi
+cat dcgm.txt
+if grep -q "^# fakedev-exporter" dcgm.txt || grep -q '", ' dcgm.txt; then
+	error_exit "DCGM identity output has default header or label separator"
+fi
+# values are rounded to integers
+if ! grep -q '^DCGM_FI_DEV_GPU_TEMP{UUID="GPU-[^}]*,gpu="1",[^}]*} [0-9]*$' dcgm.txt; then
+	error_exit "DCGM identity output lacks expected integer GPU temperature"
+fi
+rm dcgm.txt
+
+echo "$LINE"
+echo "*** Test self-metrics query working ***"
+if ! check_fetch "http://$TEST_ADDR$SELF_PATH" > self.txt; then
+	error_exit "self-metrics fetch failed"
+fi
+cat self.txt
+if ! grep -q 'fakedev_exporter_build_info{.*goversion="go[0-9]' self.txt; then
+	error_exit "self-metrics build info lacks Go version"
+fi
+rm self.txt
+
+# run_wl <exit code> <command> [args]: runs given WL command on background,
+# queries metrics from WL_URL (so that server processes WLs) until WL exits,
+# and checks that it exited with given code.  WL output is in wl.log
+WL_URL="$TEST_URL"
+run_wl () {
+	code=$1
+	shift
+	echo "try: $*"
+	"$@" > wl.log 2>&1 &
+	wpid=$!
+	for i in $(seq 10); do
+		sleep 0.5
+		wget -O/dev/null -q "$WL_URL"
+		if ! kill -0 $wpid 2>/dev/null; then
+			break
+		fi
+	done
+	kill $wpid 2>/dev/null || true
+	if wait $wpid; then
+		ret=0
+	else
+		ret=$?
+	fi
+	cat wl.log
+	if [ $ret -ne "$code" ]; then
+		error_exit "WL '$*' exited with code $ret, not $code"
+	fi
+}
+
+# run_exporter2 [args]: runs another exporter instance on background,
+# with given extra args, logging to exporter2.log
+run_exporter2 () {
+	echo "run: ${FAKEDEV##*/} $*"
+	"$FAKEDEV" \
+		--count 2 \
+		--socket $SOCKET2 \
+		--address $TEST2_ADDR \
+		--devlist "$CONFIGS/devices/devlist.json" \
+		--devtype "$CONFIGS/devices/dg1-4905.json" \
+		--identity "$CONFIGS/identity/xpu-manager.json" \
+		"$@" > exporter2.log 2>&1 &
+	pid2=$!
+	sleep 1
+}
+
+# stop_exporter2: terminates exporter instance started by run_exporter2
+stop_exporter2 () {
+	epid=$pid2
+	pid2=0
+	kill $epid
+	wait $epid || true
+}
+
+echo "$LINE"
+echo "*** Test WL with spec larger than single socket read ***"
+labels="app.kubernetes.io/name=fakedev-workload"
+for i in $(seq 40); do
+	labels="$labels,example.com/label-$i=\"value-for-label-number-$i\""
+done
+run_wl 0 env POD_LABELS="$labels" "$WORKLOAD" -socket $SOCKET -name Large \
+	-activity 10:0:1 -devnames "$DEVICES"
+
+echo "$LINE"
+echo "*** Test WL device discovery ***"
+# check_devices <devices JSON>: checks WL spec devices in wl.log
+check_devices () {
+	if ! grep -q "^.* Workload: .*\"Devices\":$1" wl.log; then
+		error_exit "WL discovered devices differ from expected $1"
+	fi
+}
+run_wl 0 env GPU_IDS="gpu-1" "$WORKLOAD" -socket $SOCKET -name FromEnv -activity 10:0:1 \
+	-device-env GPU_IDS -device-regexp 'gpu-([0-9]+)' -device-name 'cardINDEX'
+check_devices '\["card1"\]'
+echo '{"kind": "example.com/gpu", "devices": [{"name": "card0"}, {"name": "card1"}]}' > cdi.json
+run_wl 0 env GPU_IDS="example.com/gpu=card0" "$WORKLOAD" -socket $SOCKET -name FromCDI \
+	-activity 10:0:1 -cdi-spec cdi.json -device-env GPU_IDS
+check_devices '\["card0"\]'
+mkdir -p dri
+touch dri/card1 dri/renderD129
+run_wl 0 "$WORKLOAD" -socket $SOCKET -name FromGlob -activity 10:0:1 \
+	-devices "$PWD/dri/*" -device-regexp 'card([0-9]+)$' -device-name 'cardINDEX'
+check_devices '\["card1"\]'
+rm -r cdi.json dri
+
+echo "$LINE"
+echo "*** Test WL spec template with indexed job completion index ***"
+cat > indexed.json << EOF
+{
+	"Name": "indexed-{{.Index}}",
+	"Devices": ["card{{mod .Index 2}}"],
+	"Profile": [{
+		"Load": {{add 10 (mul 5 .Index)}},
+		"Seconds": {{index (list 1 2) (mod .Index 2)}}
+	}]
+}
+EOF
+run_wl 0 env JOB_COMPLETION_INDEX=3 "$WORKLOAD" -socket $SOCKET -json indexed.json
+if ! grep -q '"Name":"indexed-3".*"Load":25,.*"Seconds":2}.*"Devices":\["card1"\]' wl.log; then
+	error_exit "WL spec template was not expanded with job completion index"
+fi
+rm indexed.json
+
+echo "$LINE"
+echo "*** Test WL device selector ***"
+run_wl 0 "$WORKLOAD" -socket $SOCKET -name Selected -activity 10:0:1 \
+	-select 'pciid="0x4905"' -select 'addr=~"0000:03:.*"' -select-count 1
+# no matching devices
+run_wl 1 "$WORKLOAD" -socket $SOCKET -name Unmatched -activity 10:0:1 \
+	-select 'pciid!="0x4905"'
+
+echo "$LINE"
+echo "*** Test WL cancel being acknowledged without further queries ***"
+"$WORKLOAD" -socket $SOCKET -name Cancelled -activity 10:0:0 \
+	-devnames "$DEVICES" > cancel.log 2>&1 &
+wpid=$!
+sleep 0.5
+# query so that server accepts the WL, then cancel it without querying
+wget -O/dev/null -q "$TEST_URL"
+kill $wpid
+if wait $wpid; then
+	ret=0
+else
+	ret=$?
+fi
+cat cancel.log
+if [ $ret -ne 2 ] || ! grep -q "Exiting with code 2 returned by server" cancel.log; then
+	error_exit "WL cancel was not acknowledged by server (exit code $ret)"
+fi
+rm cancel.log
+
+echo "$LINE"
+echo "*** Test device allocated by fake kubelet being attributed to its pod ***"
+# pod owners are refreshed in background, give it few tries
+for i in 1 2 3; do
+	if check_fetch "http://$TEST_ADDR$POD_PATH" | grep 'pod="fake-pod"'; then
+		break
+	fi
+	if [ "$i" -eq 3 ]; then
+		error_exit "pod labels missing from metrics for allocated device"
+	fi
+	sleep 1
+done
+
+echo "$LINE"
+echo "*** Test device fault being reported by device plugin ***"
+if ! check_fetch --method PUT "http://$TEST_ADDR$FAULT_PATH?device=card1"; then
+	error_exit "device fault setting failed"
+fi
+if ! wait $kpid; then
+	kpid=0
+	error_exit "device plugin did not report devices and their health change to fake kubelet"
+fi
+kpid=0
+# device files are mounted to containers running as any user
+if [ "$(stat -c %a "$PLUGIN_DIR/dev/card1")" != "666" ]; then
+	error_exit "device plugin fake device file is not accessible by everybody"
+fi
+if check_fetch --method PUT "http://$TEST_ADDR$FAULT_PATH?device=foobar"; then
+	error_exit "fault for unknown device accepted"
+fi
+rm -r "$PLUGIN_DIR"
 
 echo "$LINE"
 echo "*** Test longer URL query being blocked ***"
@@ -166,14 +587,111 @@ if check_fetch --post-data="user=test" "$TEST_URL"; then
 	error_exit "POST method / BODY content accepted"
 fi
 
+echo "$LINE"
+echo "*** Test resumed WL elapsed time counting from its start, not connect ***"
+run_exporter2
+"$WORKLOAD" -socket $SOCKET2 -name Resumed -activity 10:0:30 -reconnect 10s \
+	-devnames "$DEVICES" > resume.log 2>&1 &
+wpid=$!
+# WL waits in backlog until metrics query, then exporter restart drops it
+sleep 2
+wget -O/dev/null -q "$TEST2_URL"
+stop_exporter2
+run_exporter2
+wget -O/dev/null -q "$TEST2_URL"
+kill $wpid || true
+wait $wpid || true
+cat resume.log exporter2.log
+stop_exporter2
+elapsed=$(sed -n "s/.*Resuming workload 'Resumed' at \([0-9.e+-]*\)s.*/\1/p" exporter2.log)
+if [ -z "$elapsed" ] || ! awk "BEGIN { exit !($elapsed < 2) }"; then
+	error_exit "WL was not resumed, or its elapsed time '$elapsed' included backlog wait"
+fi
+rm resume.log exporter2.log
+
+echo "$LINE"
+echo "*** Test WL device shares limit ***"
+run_exporter2 --device-shares 1
+WL_URL="$TEST2_URL"
+"$WORKLOAD" -socket $SOCKET2 -name Owner -activity 10:0:0 -devnames card0 &
+opid=$!
+sleep 0.5
+wget -O/dev/null -q "$TEST2_URL"
+run_wl 1 "$WORKLOAD" -socket $SOCKET2 -name Sharing -activity 10:0:1 -devnames card0
+if ! grep -q "reason: busy" wl.log; then
+	error_exit "WL using already owned device was not rejected as busy"
+fi
+run_wl 0 "$WORKLOAD" -socket $SOCKET2 -name Other -activity 10:0:1 -devnames card1
+kill $opid
+wait $opid || true
+stop_exporter2
+
+echo "$LINE"
+echo "*** Test WL admission queue ***"
+run_exporter2 --self-path $SELF_PATH --device-shares 1 --queue-busy --queue-size 2
+WL_URL="$TEST2_URL"
+for name in First Second Third; do
+	"$WORKLOAD" -socket $SOCKET2 -name $name -activity 10:0:1 -devnames card0 &
+	eval "${name}_pid=\$!"
+	sleep 0.3
+	wget -O/dev/null -q "$TEST2_URL"
+done
+wget -O- -q "http://$TEST2_ADDR$SELF_PATH" > self.txt
+cat self.txt
+if ! grep -q 'fakedev_exporter_workloads_queue_depth{reason="busy"} 2' self.txt; then
+	error_exit "queued WLs missing from queue depth self-metric"
+fi
+rm self.txt
+run_wl 1 "$WORKLOAD" -socket $SOCKET2 -name Fourth -activity 10:0:1 -devnames card0
+if ! grep -q "reason: queue-full" wl.log; then
+	error_exit "WL exceeding queue size was not rejected"
+fi
+# queued WLs start one at a time, as device becomes free
+for i in $(seq 20); do
+	sleep 0.5
+	wget -O/dev/null -q "$TEST2_URL"
+	if ! kill -0 "$Third_pid" 2>/dev/null; then
+		break
+	fi
+done
+for wpid in "$First_pid" "$Second_pid" "$Third_pid"; do
+	if ! wait "$wpid"; then
+		cat exporter2.log
+		error_exit "queued WL failed"
+	fi
+done
+stop_exporter2
+cat exporter2.log
+if [ "$(sed -n "s/^.*Queued WL '\([A-Za-z]*\)' started.*$/\1/p" exporter2.log | tr '\n' ' ')" != "Second Third " ]; then
+	error_exit "queued WLs were not started in queuing order"
+fi
+
+echo "$LINE"
+echo "*** Test WL accept backlog overflow being rejected without queries ***"
+run_exporter2 --accept-backlog 1
+"$WORKLOAD" -socket $SOCKET2 -name Waiting -activity 10:0:1 -devnames card0 &
+bpid=$!
+sleep 0.3
+if "$WORKLOAD" -socket $SOCKET2 -name Overflow -activity 10:0:1 -devnames card1 > wl.log 2>&1; then
+	error_exit "WL exceeding accept backlog was not rejected"
+fi
+cat wl.log
+if ! grep -q "reason: backlog-full" wl.log; then
+	error_exit "WL exceeding accept backlog was not rejected for backlog"
+fi
+stop_exporter2
+wait $bpid || true
+rm wl.log exporter2.log
+
 echo "$LINE"
 echo "Terminating '$FAKEDEV'..."
+epid=$pid
 if ! kill $pid; then
 	error_exit "killing fakedev-exporter failed"
 fi
 pid=0
 
-wait %1
+wait $epid
 ret=$?
 if [ $ret -ne 0 ]; then
 	error_exit "fakedev-exporter terminated with exit code $ret"
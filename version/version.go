@@ -0,0 +1,41 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+//
+// Package version provides build information, which Makefile
+// sets for the binaries with linker "-X" options.
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	Version   = "v0.1"
+	Revision  = "unknown"
+	Branch    = "unknown"
+	BuildUser = "unknown"
+	BuildDate = "unknown"
+	// left uninitialized so that "-X" can set it, see Go()
+	GoVersion string
+)
+
+// Go returns Go version set at build time, or if it was not,
+// the runtime one
+func Go() string {
+	if GoVersion == "" {
+		return runtime.Version()
+	}
+	return GoVersion
+}
+
+// Info returns version information for given program
+func Info(program string) string {
+	return fmt.Sprintf("%s %s (revision: %s, branch: %s, go: %s)",
+		program, Version, Revision, Branch, Go())
+}
+
+// BuildInfo returns build information for given program
+func BuildInfo(program string) string {
+	return fmt.Sprintf("%s\nbuild user: %s, date: %s", Info(program), BuildUser, BuildDate)
+}
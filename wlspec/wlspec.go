@@ -0,0 +1,208 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+//
+// Package wlspec provides workload (WL) spec types shared by
+// fakedev-exporter server and its workload clients, their validation,
+// and server reply format.
+package wlspec
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ProfileT values are in percents and seconds
+type ProfileT struct {
+	Load        int
+	Fluctuation int
+	Seconds     uint
+}
+
+// MetadataT is WL k8s pod information, provided by downward API
+type MetadataT struct {
+	Pod       string            `json:",omitempty"`
+	Namespace string            `json:",omitempty"`
+	Node      string            `json:",omitempty"`
+	Container string            `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+}
+
+// SelectorT selects WL devices based on their labels, instead of their names
+type SelectorT struct {
+	// device label matchers, all of which need to match, e.g.
+	// `pciid=0x4905` or `addr=~"0000:0a:.*"`
+	Labels []string `json:",omitempty"`
+	// if non-zero, how many of the matching devices WL needs,
+	// from ones which are not used by other WLs
+	Count uint `json:",omitempty"`
+}
+
+// MatcherT matches device label value, like Prometheus label matchers:
+// "=" (equal), "!=" (not equal), "=~" (regexp match), "!~" (no regexp match).
+// Missing label is treated as having empty value
+type MatcherT struct {
+	Label string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+var matcherRE = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// ParseMatcher returns matcher for given `<label><op><value>` string, where
+// value can be quoted, or error if string is not a valid matcher
+func ParseMatcher(text string) (*MatcherT, error) {
+	match := matcherRE.FindStringSubmatch(text)
+	if match == nil {
+		return nil, fmt.Errorf("invalid label matcher '%s', not in '<label><op><value>' format", text)
+	}
+	m := MatcherT{Label: match[1], Op: match[2], Value: match[3]}
+	if strings.HasPrefix(m.Value, `"`) {
+		value, err := strconv.Unquote(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matcher '%s' value quoting: %v", text, err)
+		}
+		m.Value = value
+	}
+	if m.Op == "=~" || m.Op == "!~" {
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matcher '%s' regexp: %v", text, err)
+		}
+		m.re = re
+	}
+	return &m, nil
+}
+
+// Matches returns true if given labels match the matcher
+func (m *MatcherT) Matches(labels map[string]string) bool {
+	value := labels[m.Label]
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// Matchers returns parsed selector label matchers, or error for first invalid one
+func (sel *SelectorT) Matchers() ([]*MatcherT, error) {
+	matchers := make([]*MatcherT, len(sel.Labels))
+	for i, text := range sel.Labels {
+		m, err := ParseMatcher(text)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return matchers, nil
+}
+
+// SpecT is WL spec sent by the clients to the server
+type SpecT struct {
+	Name    string
+	Repeat  uint
+	Profile []ProfileT
+	Devices []string
+	// alternative to Devices
+	Selector *SelectorT `json:",omitempty"`
+	Limits   map[string]float64
+	// seconds since WL was originally started, when it's resumed
+	Elapsed float64 `json:",omitempty"`
+	// k8s pod information for the WL (optional)
+	Metadata MetadataT
+}
+
+// String returns metadata in format suitable for logging
+func (md MetadataT) String() string {
+	if md.Pod == "" {
+		return "no pod info"
+	}
+	return fmt.Sprintf("pod '%s/%s', container '%s', node '%s', labels: %v",
+		md.Namespace, md.Pod, md.Container, md.Node, md.Labels)
+}
+
+// ProblemT is an invalid WL spec value, with JSON path to it
+type ProblemT struct {
+	Path string
+	Msg  string
+}
+
+func (p ProblemT) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Msg)
+}
+
+// Problems returns all values in WL spec which are invalid for simulation
+func (spec *SpecT) Problems() []ProblemT {
+	problems := make([]ProblemT, 0)
+	add := func(path, format string, args ...any) {
+		problems = append(problems, ProblemT{path, fmt.Sprintf(format, args...)})
+	}
+	if spec.Name == "" {
+		add("Name", "invalid WL name ''")
+	}
+	if len(spec.Profile) == 0 {
+		add("Profile", "no activity profile(s)")
+	}
+	if spec.Selector != nil {
+		if len(spec.Devices) > 0 {
+			add("Selector", "both Devices and Selector given")
+		}
+		if len(spec.Selector.Labels) == 0 && spec.Selector.Count == 0 {
+			add("Selector", "neither label matchers nor device count given")
+		}
+		for i, text := range spec.Selector.Labels {
+			if _, err := ParseMatcher(text); err != nil {
+				add(fmt.Sprintf("Selector.Labels[%d]", i), "%v", err)
+			}
+		}
+	}
+	if spec.Elapsed < 0 {
+		add("Elapsed", "negative elapsed time %g", spec.Elapsed)
+	}
+	for i, p := range spec.Profile {
+		path := fmt.Sprintf("Profile[%d]", i)
+		if p.Load < 0 || p.Load > 100 {
+			add(path+".Load", "per-device load %d is not within 0-100", p.Load)
+		} else if p.Fluctuation < 0 || p.Fluctuation > 100 {
+			add(path+".Fluctuation", "per-device load fluctuation %d is not within 0-100", p.Fluctuation)
+		} else if (p.Load-p.Fluctuation) < 0 || (p.Load+p.Fluctuation) > 100 {
+			add(path, "per-device %d load +/- %d fluctuation is not within 0-100", p.Load, p.Fluctuation)
+		}
+	}
+	return problems
+}
+
+// Validate checks that WL spec values are valid for simulation,
+// and returns error describing first invalid value
+func (spec *SpecT) Validate() error {
+	if problems := spec.Problems(); len(problems) > 0 {
+		return fmt.Errorf("WL '%s' with invalid %v", spec.Name, problems[0])
+	}
+	return nil
+}
+
+// StartedReply is sent by server to WL when its simulation starts (WL
+// may first wait in a queue), before the final exit code reply
+const StartedReply = "+"
+
+// ErrorReply returns server reply telling WL to exit with an error code,
+// because it was rejected for given reason
+func ErrorReply(reason string) string {
+	return "1:" + reason
+}
+
+// ParseReply parses server reply to WL, which is "<exit code>", optionally
+// followed by ":<reason>" for rejected WLs, and preceded by StartedReply
+// for started ones.  Returns exit code and reason
+func ParseReply(reply string) (int, string, error) {
+	code, reason, _ := strings.Cut(strings.TrimPrefix(reply, StartedReply), ":")
+	ret, err := strconv.Atoi(code)
+	return ret, reason, err
+}
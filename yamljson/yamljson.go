@@ -0,0 +1,36 @@
+// Copyright 2022 Intel Corporation
+// SPDX-License-Identifier: Apache-2.0
+//
+// Package yamljson converts YAML config files to JSON, so that same
+// (JSON) schemas and unmarshaling can be used for both formats.
+package yamljson
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// IsYAML returns true if given file name extension is for YAML, or if
+// content does not look like JSON, i.e. start with an object or array
+func IsYAML(name string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] != '{' && data[0] != '['
+}
+
+// ToJSON returns given file content converted to JSON, if it is YAML,
+// otherwise content is returned as-is
+func ToJSON(name string, data []byte) ([]byte, error) {
+	if !IsYAML(name, data) {
+		return data, nil
+	}
+	return yaml.YAMLToJSON(data)
+}